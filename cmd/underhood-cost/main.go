@@ -0,0 +1,89 @@
+// Command underhood-cost predicts the communication and compute costs of
+// the PIR scheme for a database of a given shape, without running it.
+//
+//    go run ./cmd/underhood-cost -num 1000000 -bits 8 -elem 32
+//    go run ./cmd/underhood-cost -num 1000000 -bits 8 -elem 64 -calibrate 1s
+package main
+
+import (
+  "os"
+  "fmt"
+  "flag"
+  "time"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/underhood"
+  "github.com/ahenzinger/underhood/underhood/cost"
+)
+
+func main() {
+  num := flag.Uint64("num", 1<<20, "number of database elements")
+  bits := flag.Uint64("bits", 8, "bits per element")
+  elem := flag.Uint64("elem", 64, "ciphertext width (32 or 64)")
+  samples := flag.Uint64("samples", 0, "number of LWE samples, i.e., database columns (0 to choose automatically)")
+  p := flag.Uint64("p", 0, "SimplePIR plaintext modulus (0 to choose automatically)")
+  secrets := flag.Uint64("secrets", 1, "secrets per token request")
+  calibrate := flag.Duration("calibrate", 0, "time per micro-benchmark (0 to use default costs)")
+  flag.Parse()
+
+  cfg := cost.Config{
+    Num: *num,
+    RecordBits: *bits,
+    ElemBits: *elem,
+    Secrets: *secrets,
+  }
+  if *samples != 0 || *p != 0 {
+    if *samples == 0 || *p == 0 {
+      fmt.Fprintln(os.Stderr, "Must give both -samples and -p")
+      os.Exit(2)
+    }
+    cfg.Params = lwe.NewParamsFixedP(*elem, *samples, *p)
+    if cfg.Params == nil {
+      fmt.Fprintf(os.Stderr, "No secure parameters with %d samples and p=%d\n", *samples, *p)
+      os.Exit(1)
+    }
+  }
+
+  cal := cost.DefaultCalibration()
+  if *calibrate > 0 {
+    cal = cost.Calibrate(*calibrate)
+  }
+
+  e, err := cost.Predict(cfg, cal)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+
+  info := e.Info
+  fmt.Printf("Database:      %d x %d matrix (n=%d, p=%d, %d elements per record)\n",
+             info.L, info.M, info.Params.N, info.P(), info.Ne)
+  fmt.Printf("Upload:        HintQuery %s, Query %s\n", bytes(e.HintQueryBytes), bytes(e.QueryBytes))
+  fmt.Printf("Download:      HintAnswer %s, Answer %s\n", bytes(e.HintAnswerBytes), bytes(e.AnswerBytes))
+  fmt.Printf("Server time:   preprocess %v, HintAnswer %v, Answer %v (one core)\n",
+             e.PreprocessTime.Round(time.Millisecond), e.HintAnswerTime.Round(time.Millisecond),
+             e.AnswerTime.Round(time.Microsecond))
+  fmt.Printf("Client memory: %s\n", bytes(e.ClientBytes))
+
+  var f *underhood.FailureReport
+  if *elem == 32 {
+    f = underhood.AnalyzeFailure[matrix.Elem32](info)
+  } else {
+    f = underhood.AnalyzeFailure[matrix.Elem64](info)
+  }
+  fmt.Printf("Failure:       2^%.1f per query (token 2^%.1f, decoding 2^%.1f)\n",
+             f.FailureLog2, f.TokenFailureLog2, f.DecodeFailureLog2)
+}
+
+func bytes(b uint64) string {
+  const unit = 1024
+  if b < unit {
+    return fmt.Sprintf("%d B", b)
+  }
+  div, exp := uint64(unit), 0
+  for v := b / unit; v >= unit; v /= unit {
+    div *= unit
+    exp += 1
+  }
+  return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
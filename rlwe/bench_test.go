@@ -71,7 +71,7 @@ func BenchmarkPlainMulNTT(b *testing.B) {
 
 type IPFunc = func(*Ciphertext, *Context, []*Ciphertext, []*Plaintext)
 
-func benchmarkIP(b *testing.B, f IPFunc) {
+func benchmarkIP(b *testing.B, f IPFunc, useNTT bool) {
   ctx := NewContext()
   defer ctx.Free()
 
@@ -99,7 +99,9 @@ func benchmarkIP(b *testing.B, f IPFunc) {
     pts[i].Set(ctx, vals)
     key.Encrypt(pts[i], cts[i])
     pts[i].ToNTT(ctx)
-    cts[i].ToNTT(ctx)
+    if useNTT {
+      cts[i].ToNTT(ctx)
+    }
   }
 
   b.ResetTimer()
@@ -110,5 +112,18 @@ func benchmarkIP(b *testing.B, f IPFunc) {
 }
 
 func BenchmarkInnerProduct(b *testing.B) {
-  benchmarkIP(b, (*Ciphertext).SetInnerProduct)
+  benchmarkIP(b, (*Ciphertext).SetInnerProduct, true)
+}
+
+func BenchmarkInnerProductReference(b *testing.B) {
+  benchmarkIP(b, (*Ciphertext).setInnerProductReference, true)
+}
+
+// As in applyHint: the ciphertexts are not in NTT form.
+func BenchmarkInnerProductHint(b *testing.B) {
+  benchmarkIP(b, (*Ciphertext).SetInnerProduct, false)
+}
+
+func BenchmarkInnerProductHintReference(b *testing.B) {
+  benchmarkIP(b, (*Ciphertext).setInnerProductReference, false)
 }
@@ -0,0 +1,135 @@
+package rlwe
+
+import (
+  "errors"
+  "testing"
+  "math/rand"
+)
+
+func TestPublicKey(t *testing.T) {
+  ctx := NewContextPublic()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  // The public key survives a round trip through storage
+  pk1 := key.PublicKey(ctx)
+  defer pk1.Free()
+  pk, err := LoadPublicKey(ctx, pk1.Store())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pk.Free()
+
+  vals := make([]uint64, ctx.N())
+  for i := range vals {
+    vals[i] = uint64(i) % ctx.P()
+  }
+
+  ct := NewCiphertext()
+  defer ct.Free()
+  pk.EncryptPublicSlice(ctx, vals, ct)
+
+  // Through storage, too
+  ct2 := NewCiphertext()
+  defer ct2.Free()
+  if err := ct2.Load(ctx, ct.Store()); err != nil {
+    t.Fatal(err)
+  }
+
+  pt := NewPlaintext()
+  defer pt.Free()
+  if err := key.Decrypt(ct2, pt); err != nil {
+    t.Fatal(err)
+  }
+  out := make([]uint64, ctx.N())
+  pt.Dump(out)
+  for i := range vals {
+    if out[i] != vals[i] {
+      t.Fatalf("Decrypted %v, want %v", out[i], vals[i])
+    }
+  }
+}
+
+func TestPublicKeyMalformed(t *testing.T) {
+  ctx := NewContextPublic()
+  defer ctx.Free()
+
+  other := NewContext()
+  defer other.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+  pk := key.PublicKey(ctx)
+  defer pk.Free()
+  stored := pk.Store()
+
+  inputs := [][]byte{ nil, stored[:len(stored)/2], make([]byte, len(stored)) }
+  for i, in := range inputs {
+    if _, err := LoadPublicKey(ctx, in); !errors.Is(err, ErrMalformedKey) {
+      t.Fatalf("Input %d: got %v, want ErrMalformedKey", i, err)
+    }
+  }
+
+  // A key under other parameters
+  if _, err := LoadPublicKey(other, stored); !errors.Is(err, ErrMalformedKey) {
+    t.Fatalf("Got %v, want ErrMalformedKey", err)
+  }
+}
+
+// The token protocol multiplies each public-key encryption of a secret
+// value (at most 2) with a plaintext of 4-bit limbs, and sums thousands
+// of these products: the result must still decrypt.
+func TestPublicKeyInnerProduct(t *testing.T) {
+  ctx := NewContextPublic()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+  pk := key.PublicKey(ctx)
+  defer pk.Free()
+
+  const terms = 2048
+  n := ctx.N()
+  cts := make([]*Ciphertext, terms)
+  pts := make([]*Plaintext, terms)
+  want := make([]uint64, n)
+  vals := make([]uint64, n)
+
+  for i := range cts {
+    secret := uint64(rand.Intn(3))
+    vals[0] = secret
+    cts[i] = NewCiphertext()
+    defer cts[i].Free()
+    pk.EncryptPublicSlice(ctx, vals, cts[i])
+
+    limbs := make([]uint64, n)
+    for j := range limbs {
+      limbs[j] = uint64(rand.Intn(16))
+      want[j] = (want[j] + secret*limbs[j]) % ctx.P()
+    }
+    pts[i] = NewPlaintext()
+    defer pts[i].Free()
+    pts[i].Set(ctx, limbs)
+    pts[i].ToNTT(ctx)
+  }
+  vals[0] = 0
+
+  out := NewCiphertext()
+  defer out.Free()
+  out.SetInnerProduct(ctx, cts, pts)
+
+  pt := NewPlaintext()
+  defer pt.Free()
+  if err := key.Decrypt(out, pt); err != nil {
+    t.Fatal(err)
+  }
+  got := make([]uint64, n)
+  pt.Dump(got)
+  for j := range want {
+    if got[j] != want[j] {
+      t.Fatalf("At %d: got %v, want %v", j, got[j], want[j])
+    }
+  }
+}
@@ -1,6 +1,7 @@
 #include "rlwe.h"
 #include "rlwe.hpp"
 #include <seal/seal.h>
+#include <seal/util/uintarithsmallmod.h>
 #include <cassert>
 #include <cmath>
 
@@ -22,18 +23,24 @@ struct plaintext_s {
   plaintext_s() : pt(Plaintext(MemoryPoolHandle::Global())) {};
 };
 
+struct pkey_s {
+  PublicKey pk;
+  Encryptor encryptor;
+  pkey_s(SEALContext &ctx, const PublicKey &pk_in) : pk(pk_in), encryptor(ctx, pk) {};
+};
+
 struct skey_s {
   CryptoKey key;
   skey_s(SEALContext &ctx) : key(ctx) {};
+  skey_s(SEALContext &ctx, const SecretKey &sk) : key(ctx, sk) {};
 };
 
-context_t *context_new() {
-  EncryptionParameters parms(scheme_type::bfv);
-
-  size_t poly_modulus_degree = 2048;  
+// Set the BFV parameters (keeping any random generator in 'parms').
+static context_t *context_from_parms(EncryptionParameters &parms,
+                                     size_t poly_modulus_degree, int coeff_bits) {
   parms.set_poly_modulus_degree(poly_modulus_degree);
   parms.set_plain_modulus(Modulus(65537));
-  parms.set_coeff_modulus(CoeffModulus::Create(poly_modulus_degree, 65537, {38})); 
+  parms.set_coeff_modulus(CoeffModulus::Create(poly_modulus_degree, 65537, {coeff_bits})); 
 
   SEALContext test_ctx(parms);
   if (!test_ctx.parameters_set()) {
@@ -50,6 +57,31 @@ context_t *context_new() {
   return ctx;
 }
 
+context_t *context_new() {
+  EncryptionParameters parms(scheme_type::bfv);
+  return context_from_parms(parms, 2048, 38);
+}
+
+// Public-key encryption adds the product of the public key's error with
+// the encryption randomness, which is too much noise for the 38-bit
+// modulus once the server sums thousands of products. Use a larger ring,
+// so that a 54-bit modulus keeps the same security.
+context_t *context_new_public() {
+  EncryptionParameters parms(scheme_type::bfv);
+  return context_from_parms(parms, 4096, 54);
+}
+
+// 'seed' holds prng_seed_uint64_count words.
+context_t *context_new_seeded(const uint64_t *seed) {
+  static_assert(prng_seed_uint64_count == 8, "Go side passes 8 words");
+  prng_seed_type prng_seed;
+  copy_n(seed, prng_seed.size(), prng_seed.begin());
+
+  EncryptionParameters parms(scheme_type::bfv);
+  parms.set_random_generator(make_shared<SeededPRNGFactory>(prng_seed));
+  return context_from_parms(parms, 2048, 38);
+}
+
 void context_free(context_t *ctx_in) {
   delete ctx_in->ctx;
   free(ctx_in);
@@ -131,8 +163,23 @@ void ciphertext_store(ciphertext_t *ct, uint8_t *dst, size_t sz) {
   ct->ct.save((seal_byte*) dst, sz, compr_mode_type::none);
 }
 
-void ciphertext_load(context_t *ctx, ciphertext_t *ct_out, uint8_t *src, size_t sz) {
-  ct_out->ct.load(ctx->ctx->context, (const seal_byte*) src, sz);
+// Returns false (rather than throwing) on malformed input, or on a
+// ciphertext that is not a fresh-sized ciphertext under this context's
+// parameters.
+bool ciphertext_load(context_t *ctx, ciphertext_t *ct_out, uint8_t *src, size_t sz) {
+  try {
+    ct_out->ct.load(ctx->ctx->context, (const seal_byte*) src, sz);
+  } catch (const exception &e) {
+    return false;
+  }
+
+  return (ct_out->ct.parms_id() == ctx->ctx->parms_id) &&
+         (ct_out->ct.size() == 2) &&
+         (!ct_out->ct.is_ntt_form());
+}
+
+bool ciphertext_is_NTT(ciphertext_t *ct) {
+  return ct->ct.is_ntt_form();
 }
 
 void ciphertext_to_NTT(context_t *ctx, ciphertext_t *ct) {
@@ -152,7 +199,7 @@ void ciphertext_add(context_t *ctx, ciphertext_t *ct, ciphertext_t *other) {
   ctx->ctx->evaluator.add_inplace(ct->ct, other->ct);
 }
 
-void ciphertext_set_inner_product(context_t *ctx, ciphertext_t *out, ciphertext_t **cts, plaintext_t **pts, size_t len) {
+void ciphertext_set_inner_product_reference(context_t *ctx, ciphertext_t *out, ciphertext_t **cts, plaintext_t **pts, size_t len) {
   for (size_t i=0; i<len; i++) {
     Ciphertext tmp = cts[i]->ct;
     ctx->ctx->evaluator.multiply_plain_inplace(tmp, pts[i]->pt);
@@ -165,10 +212,110 @@ void ciphertext_set_inner_product(context_t *ctx, ciphertext_t *out, ciphertext_
   }
 }
 
+__extension__ typedef unsigned __int128 uint128_t;
+
+// Fold the 128-bit accumulators into [0, q).
+static void reduce_accumulators(uint128_t *acc, size_t len, const Modulus &q) {
+  for (size_t k=0; k<len; k++) {
+    uint64_t words[2] = { static_cast<uint64_t>(acc[k]), static_cast<uint64_t>(acc[k] >> 64) };
+    acc[k] = util::barrett_reduce_128(words, q);
+  }
+}
+
+// Compute the inner product in the NTT domain, where multiplying by a
+// plaintext is coefficient-wise. Rather than reduce mod q after each
+// multiply and each add, accumulate the products in 128 bits, and reduce
+// only when the accumulators could overflow (for a 38-bit modulus, never)
+// and at the end. Falls back to the reference loop on plaintexts that are
+// not in NTT form.
+void ciphertext_set_inner_product(context_t *ctx, ciphertext_t *out, ciphertext_t **cts, plaintext_t **pts, size_t len) {
+  assert(len > 0);
+  for (size_t i=0; i<len; i++) {
+    if (!pts[i]->pt.is_ntt_form()) {
+      ciphertext_set_inner_product_reference(ctx, out, cts, pts, len);
+      return;
+    }
+  }
+
+  const auto ctx_data = ctx->ctx->context.get_context_data(ctx->ctx->parms_id);
+  assert(ctx_data->parms().coeff_modulus().size() == 1);
+  const Modulus &q = ctx_data->parms().coeff_modulus()[0];
+  const size_t n = ctx->ctx->n;
+  const bool in_ntt = cts[0]->ct.is_ntt_form();
+
+  // Each product is below q^2: reduce before 'lazy' of them can overflow
+  const uint128_t q2 = static_cast<uint128_t>(q.value()) * q.value();
+  const uint128_t max_terms = (~static_cast<uint128_t>(0)) / q2 - 1;
+  const size_t lazy = max_terms < len ? static_cast<size_t>(max_terms) : len;
+
+  vector<uint128_t> acc(2*n, 0);
+  Ciphertext tmp(MemoryPoolHandle::Global());
+  size_t pending = 0;
+
+  for (size_t i=0; i<len; i++) {
+    assert(cts[i]->ct.size() == 2);
+    assert(cts[i]->ct.is_ntt_form() == in_ntt);
+
+    const Ciphertext *ct = &cts[i]->ct;
+    if (!in_ntt) {
+      tmp = *ct;
+      ctx->ctx->evaluator.transform_to_ntt_inplace(tmp);
+      ct = &tmp;
+    }
+
+    const uint64_t *pt = pts[i]->pt.data();
+    for (size_t j=0; j<2; j++) {
+      const uint64_t *c = ct->data(j);
+      uint128_t *a = acc.data() + j*n;
+      for (size_t k=0; k<n; k++) {
+        a[k] += static_cast<uint128_t>(c[k]) * pt[k];
+      }
+    }
+
+    if (++pending == lazy) {
+      reduce_accumulators(acc.data(), acc.size(), q);
+      pending = 1;  // the folded values count as one term
+    }
+  }
+  reduce_accumulators(acc.data(), acc.size(), q);
+
+  // Take the output's shape and metadata from an input
+  out->ct = cts[0]->ct;
+  out->ct.is_ntt_form() = true;
+  for (size_t j=0; j<2; j++) {
+    uint64_t *o = out->ct.data(j);
+    for (size_t k=0; k<n; k++) {
+      o[k] = static_cast<uint64_t>(acc[j*n + k]);
+    }
+  }
+
+  if (!in_ntt) {
+    ctx->ctx->evaluator.transform_from_ntt_inplace(out->ct);
+  }
+}
+
 skey_t *key_new(context_t *ctx_in) {
   return new skey_s(ctx_in->ctx->context);
 }
 
+// Sample the secret key with a PRNG seeded with 'seed' (which holds
+// prng_seed_uint64_count words). KeyGenerator draws one PRNG for the
+// secret key, so the key depends only on the seed and the parameters.
+skey_t *key_new_from_seed(context_t *ctx_in, const uint64_t *seed) {
+  static_assert(prng_seed_uint64_count == 8, "Go side passes 8 words");
+  prng_seed_type prng_seed;
+  copy_n(seed, prng_seed.size(), prng_seed.begin());
+
+  // The random generator is not part of the parameters' ID, so the key is
+  // valid in the original context.
+  EncryptionParameters parms = ctx_in->ctx->context.key_context_data()->parms();
+  parms.set_random_generator(make_shared<Blake2xbPRNGFactory>(prng_seed));
+  SEALContext key_ctx(parms);
+  KeyGenerator keygen(key_ctx);
+
+  return new skey_s(ctx_in->ctx->context, keygen.secret_key());
+}
+
 void key_free(skey_t *sk) {
   delete sk;
 }
@@ -187,14 +334,28 @@ size_t key_encrypt_squished_size(skey_t *key, plaintext_t *pt) {
   return static_cast<size_t>(cs.save_size(compr_mode_type::none));
 }
 
-void key_decrypt(skey_t *key, ciphertext_t *ct, plaintext_t *pt) {
-  if (key->key.decryptor.invariant_noise_budget(ct->ct) == 0) {
-    cout << "Noise budget exceeded" << endl;
-    assert(false);
+// Returns false if the ciphertext's noise is too large to decrypt correctly.
+bool key_decrypt(skey_t *key, ciphertext_t *ct, plaintext_t *pt) {
+  try {
+    if (key->key.decryptor.invariant_noise_budget(ct->ct) == 0) {
+      return false;
+    }
+
+    //cout << "Noise budget: " << key->key.decryptor.invariant_noise_budget(ct->ct) << endl;
+    key->key.decryptor.decrypt(ct->ct, pt->pt);
+  } catch (const exception &e) {
+    return false;
+  }
+  return true;
+}
+
+// Returns -1 if the ciphertext is malformed (or in NTT form).
+int key_noise_budget(skey_t *key, ciphertext_t *ct) {
+  try {
+    return key->key.decryptor.invariant_noise_budget(ct->ct);
+  } catch (const exception &e) {
+    return -1;
   }
-  
-  //cout << "Noise budget: " << key->key.decryptor.invariant_noise_budget(ct->ct) << endl;
-  key->key.decryptor.decrypt(ct->ct, pt->pt);
 }
 
 size_t key_size(skey_t *key) {
@@ -208,3 +369,42 @@ void key_store(skey_t *key, uint8_t *dst, size_t sz) {
 void key_load(context_t *ctx, skey_t *key, uint8_t *src, size_t sz) {
   key->key.set_key(ctx->ctx->context, src, sz);
 }
+
+pkey_t *key_public_key(context_t *ctx, skey_t *key) {
+  KeyGenerator keygen(ctx->ctx->context, key->key.sk);
+  PublicKey pk;
+  keygen.create_public_key(pk);
+  return new pkey_s(ctx->ctx->context, pk);
+}
+
+void pkey_free(pkey_t *pk) {
+  delete pk;
+}
+
+size_t pkey_size(pkey_t *pk) {
+  return static_cast<size_t>(pk->pk.save_size(compr_mode_type::none));
+}
+
+void pkey_store(pkey_t *pk, uint8_t *dst, size_t sz) {
+  pk->pk.save((seal_byte*) dst, sz, compr_mode_type::none);
+}
+
+// Returns NULL (rather than throwing) on malformed input, or on a key
+// under other parameters.
+pkey_t *pkey_load(context_t *ctx, uint8_t *src, size_t sz) {
+  PublicKey pk;
+  try {
+    pk.load(ctx->ctx->context, (const seal_byte*) src, sz);
+  } catch (const exception &e) {
+    return NULL;
+  }
+
+  if (pk.parms_id() != ctx->ctx->context.key_parms_id()) {
+    return NULL;
+  }
+  return new pkey_s(ctx->ctx->context, pk);
+}
+
+void pkey_encrypt(pkey_t *pk, plaintext_t *pt, ciphertext_t *ct) {
+  pk->encryptor.encrypt(pt->pt, ct->ct, MemoryPoolHandle::Global());
+}
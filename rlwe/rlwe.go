@@ -5,6 +5,18 @@ package rlwe
 // #include "rlwe.h"
 import "C"
 
+import (
+  "io"
+  "errors"
+  "crypto/rand"
+  "crypto/sha512"
+  "encoding/binary"
+)
+
+var ErrMalformedCiphertext = errors.New("rlwe: malformed ciphertext")
+var ErrDecryptionFailed = errors.New("rlwe: noise budget exceeded")
+var ErrMalformedKey = errors.New("rlwe: malformed public key")
+
 type Context struct {
   ctx *C.context_t
 }
@@ -19,12 +31,69 @@ type Key struct {
   key *C.skey_t
 }
 
+type PublicKey struct {
+  pk *C.pkey_t
+}
+
 func NewContext() *Context {
   return &Context{
     ctx: C.context_new(),
   }
 }
 
+// Length of the seed of a seeded context.
+const SeedBytes = 32
+
+type Seed [SeedBytes]byte
+
+// A fresh random seed.
+func NewSeed() *Seed {
+  seed := new(Seed)
+  if _, err := io.ReadFull(rand.Reader, seed[:]); err != nil {
+    panic(err)
+  }
+  return seed
+}
+
+// Number of 64-bit words in a SEAL PRNG seed.
+const prngSeedWords = 8
+
+// Expand 'seed' into a SEAL PRNG seed, separately for each 'purpose'.
+func expandSeed(seed *Seed, purpose string) [prngSeedWords]uint64 {
+  h := sha512.New()
+  h.Write([]byte("underhood/rlwe: " + purpose))
+  h.Write(seed[:])
+  sum := h.Sum(nil)
+
+  var out [prngSeedWords]uint64
+  for i := range out {
+    out[i] = binary.LittleEndian.Uint64(sum[8*i:])
+  }
+  return out
+}
+
+// Output a context whose randomness (for key generation and encryption)
+// derives from 'seed'. Keys and ciphertexts are then deterministic, given
+// the order of the calls that draw randomness: this is for reproducible
+// tests only. Never use a seeded context to protect real data, since
+// anyone who knows the seed can decrypt.
+func NewContextSeeded(seed *Seed) *Context {
+  words := expandSeed(seed, "context")
+  return &Context{
+    ctx: C.context_new_seeded((*C.uint64_t)(&words[0])),
+  }
+}
+
+// Output a context for public-key encryption (see PublicKey). Public-key
+// ciphertexts carry more noise than symmetric ones, so this context uses
+// ring dimension 4096 and a 54-bit modulus (rather than 2048 and 38 bits).
+// Its keys and ciphertexts do not work in the other contexts.
+func NewContextPublic() *Context {
+  return &Context{
+    ctx: C.context_new_public(),
+  }
+}
+
 func (ctx *Context) Free() {
   C.context_free(ctx.ctx)
 }
@@ -83,8 +152,21 @@ func (ct *Ciphertext) Store() []byte {
   return out
 }
 
-func (ct *Ciphertext) Load(ctx *Context, in []byte) {
-  C.ciphertext_load(ctx.ctx, (*C.ciphertext_t)(ct), (*C.uint8_t)(&in[0]), C.size_t(len(in)))
+// Returns ErrMalformedCiphertext if 'in' is not a valid serialized
+// ciphertext under the parameters of 'ctx'.
+func (ct *Ciphertext) Load(ctx *Context, in []byte) error {
+  if len(in) == 0 {
+    return ErrMalformedCiphertext
+  }
+
+  if !C.ciphertext_load(ctx.ctx, (*C.ciphertext_t)(ct), (*C.uint8_t)(&in[0]), C.size_t(len(in))) {
+    return ErrMalformedCiphertext
+  }
+  return nil
+}
+
+func (ct *Ciphertext) IsNTT() bool {
+  return bool(C.ciphertext_is_NTT((*C.ciphertext_t)(ct)))
 }
 
 func (ct *Ciphertext) ToNTT(ctx *Context) {
@@ -103,8 +185,31 @@ func (ct *Ciphertext) Add(ctx *Context, other *Ciphertext) {
   C.ciphertext_add(ctx.ctx, (*C.ciphertext_t)(ct), (*C.ciphertext_t)(other))
 }
 
+// Set ct to the sum of cts[i] x pts[i]. With plaintexts in NTT form, this
+// runs a fused multiply-accumulate in the NTT domain (see rlwe.cpp); the
+// ciphertexts may be in either form, and the output is in the same form.
 func (ct *Ciphertext) SetInnerProduct(ctx *Context, cts []*Ciphertext, pts []*Plaintext) {
-  if len(cts) != len(pts) {
+  ctsC, ptsC := innerProductArgs(cts, pts)
+  C.ciphertext_set_inner_product(ctx.ctx, 
+                                 (*C.ciphertext_t)(ct),
+                                 (**C.ciphertext_t)(&ctsC[0]), 
+				 (**C.plaintext_t)(&ptsC[0]), 
+				 C.size_t(len(ctsC)))
+}
+
+// The multiply-then-add loop that SetInnerProduct replaces (for tests and
+// benchmarks).
+func (ct *Ciphertext) setInnerProductReference(ctx *Context, cts []*Ciphertext, pts []*Plaintext) {
+  ctsC, ptsC := innerProductArgs(cts, pts)
+  C.ciphertext_set_inner_product_reference(ctx.ctx, 
+                                           (*C.ciphertext_t)(ct),
+                                           (**C.ciphertext_t)(&ctsC[0]), 
+                                           (**C.plaintext_t)(&ptsC[0]), 
+                                           C.size_t(len(ctsC)))
+}
+
+func innerProductArgs(cts []*Ciphertext, pts []*Plaintext) ([]*C.ciphertext_t, []*C.plaintext_t) {
+  if len(cts) != len(pts) || len(cts) == 0 {
     panic("Invalid arguments")
   }
 
@@ -116,12 +221,7 @@ func (ct *Ciphertext) SetInnerProduct(ctx *Context, cts []*Ciphertext, pts []*Pl
     ctsC[i] = (*C.ciphertext_t)(cts[i])
     ptsC[i] = (*C.plaintext_t)(pts[i])
   }
-
-  C.ciphertext_set_inner_product(ctx.ctx, 
-                                 (*C.ciphertext_t)(ct),
-                                 (**C.ciphertext_t)(&ctsC[0]), 
-				 (**C.plaintext_t)(&ptsC[0]), 
-				 C.size_t(n))
+  return ctsC, ptsC
 }
 
 func (ctx *Context) NewKey() *Key {
@@ -130,6 +230,17 @@ func (ctx *Context) NewKey() *Key {
   }
 }
 
+// Derive a secret key from 'seed', so that a client can store the 32-byte
+// seed rather than the serialized key. The key is a deterministic function
+// of the seed: the KDF (SHA-512, with a domain separator) expands the seed
+// into the seed of SEAL's Blake2xb PRNG, which samples the key.
+func (ctx *Context) NewKeyFromSeed(seed *Seed) *Key {
+  words := expandSeed(seed, "secret key")
+  return &Key{
+    key: C.key_new_from_seed(ctx.ctx, (*C.uint64_t)(&words[0])),
+  }
+}
+
 func (key *Key) Free() {
   C.key_free(key.key)
 }
@@ -169,8 +280,24 @@ func (key *Key) EncryptZero(ctx *Context, ct *Ciphertext) {
   key.Encrypt(pt, ct)
 }
 
-func (key *Key) Decrypt(ct *Ciphertext, pt *Plaintext) {
-  C.key_decrypt(key.key, (*C.ciphertext_t)(ct), (*C.plaintext_t)(pt))
+// Returns ErrDecryptionFailed if the ciphertext's noise is too large.
+func (key *Key) Decrypt(ct *Ciphertext, pt *Plaintext) error {
+  if !C.key_decrypt(key.key, (*C.ciphertext_t)(ct), (*C.plaintext_t)(pt)) {
+    return ErrDecryptionFailed
+  }
+  return nil
+}
+
+// SEAL's invariant noise budget of 'ct', in bits: decryption is correct
+// while it is positive, and each bit less means twice the noise. The
+// noise is below q/(t x 2^(budget+1)), and at least half of that. 'ct'
+// must be in coefficient form.
+func (key *Key) NoiseBudget(ct *Ciphertext) int {
+  budget := int(C.key_noise_budget(key.key, (*C.ciphertext_t)(ct)))
+  if budget < 0 {
+    panic("Ciphertext is malformed or in NTT form")
+  }
+  return budget
 }
 
 func (key *Key) Size() int {
@@ -186,3 +313,56 @@ func (key *Key) Store() []byte {
 func (key *Key) Load(ctx *Context, in []byte) {
   C.key_load(ctx.ctx, key.key, (*C.uint8_t)(&in[0]), C.size_t(len(in)))
 }
+
+// Output the public key that matches this secret key. Anyone who holds the
+// public key can encrypt (but not decrypt) under this key.
+//
+// Beware! You must call Free() on the output PublicKey.
+func (key *Key) PublicKey(ctx *Context) *PublicKey {
+  return &PublicKey{
+    pk: C.key_public_key(ctx.ctx, key.key),
+  }
+}
+
+// Returns ErrMalformedKey if 'in' is not a valid serialized public key
+// under the parameters of 'ctx'.
+//
+// Beware! You must call Free() on the output PublicKey.
+func LoadPublicKey(ctx *Context, in []byte) (*PublicKey, error) {
+  if len(in) == 0 {
+    return nil, ErrMalformedKey
+  }
+
+  pk := C.pkey_load(ctx.ctx, (*C.uint8_t)(&in[0]), C.size_t(len(in)))
+  if pk == nil {
+    return nil, ErrMalformedKey
+  }
+  return &PublicKey{ pk: pk }, nil
+}
+
+func (pk *PublicKey) Free() {
+  C.pkey_free(pk.pk)
+}
+
+func (pk *PublicKey) Size() int {
+  return int(C.pkey_size(pk.pk))
+}
+
+func (pk *PublicKey) Store() []byte {
+  out := make([]byte, pk.Size())
+  C.pkey_store(pk.pk, (*C.uint8_t)(&out[0]), C.size_t(len(out)))
+  return out
+}
+
+// Public-key ciphertexts cannot be stored in seeded (squished) form, so
+// they are twice the size of the output of Key.EncryptSquished.
+func (pk *PublicKey) EncryptPublic(pt *Plaintext, ct *Ciphertext) {
+  C.pkey_encrypt(pk.pk, (*C.plaintext_t)(pt), (*C.ciphertext_t)(ct))
+}
+
+func (pk *PublicKey) EncryptPublicSlice(ctx *Context, in []uint64, ct *Ciphertext) {
+  pt := NewPlaintext()
+  pt.Set(ctx, in)
+  defer pt.Free()
+  pk.EncryptPublic(pt, ct)
+}
@@ -17,9 +17,12 @@ typedef struct context_s context_t;
 typedef struct ciphertext_s ciphertext_t;
 typedef struct plaintext_s plaintext_t;
 typedef struct skey_s skey_t;
+typedef struct pkey_s pkey_t;
 
 // Initialization
 context_t* context_new();
+context_t* context_new_seeded(const uint64_t *seed);
+context_t* context_new_public();
 void context_free(context_t *ctx);
 
 // Debug
@@ -46,21 +49,25 @@ void ciphertext_copy(ciphertext_t *src, ciphertext_t *dst);
 
 size_t ciphertext_size(ciphertext_t *ct_in);
 void ciphertext_store(ciphertext_t *ct_in, uint8_t *dst, size_t sz);
-void ciphertext_load(context_t *ctx, ciphertext_t *ct_out, uint8_t *src, size_t sz);
+bool ciphertext_load(context_t *ctx, ciphertext_t *ct_out, uint8_t *src, size_t sz);
 
+bool ciphertext_is_NTT(ciphertext_t *ct);
 void ciphertext_to_NTT(context_t *c, ciphertext_t *ct);
 void ciphertext_from_NTT(context_t *c, ciphertext_t *ct);
 
 void ciphertext_multiply_plain(context_t *ctx, ciphertext_t *ct, plaintext_t *pt);
 void ciphertext_add(context_t *ctx, ciphertext_t *ct, ciphertext_t *other);
 void ciphertext_set_inner_product(context_t *ctx, ciphertext_t *out, ciphertext_t **cts, plaintext_t **pts, size_t len);
+void ciphertext_set_inner_product_reference(context_t *ctx, ciphertext_t *out, ciphertext_t **cts, plaintext_t **pts, size_t len);
 
 // Key generation
 skey_t *key_new(context_t *ctx_in);
+skey_t *key_new_from_seed(context_t *ctx_in, const uint64_t *seed);
 void key_free(skey_t *key_in);
 
 void key_encrypt(skey_t *key, plaintext_t *pt, ciphertext_t *ct);
-void key_decrypt(skey_t *key, ciphertext_t *ct, plaintext_t *pt);
+bool key_decrypt(skey_t *key, ciphertext_t *ct, plaintext_t *pt);
+int key_noise_budget(skey_t *key, ciphertext_t *ct);
 void key_encrypt_squished(skey_t *key, plaintext_t *pt, uint8_t *dst, size_t sz);
 size_t key_encrypt_squished_size(skey_t *key, plaintext_t *msg);
 
@@ -68,6 +75,16 @@ size_t key_size(skey_t *key);
 void key_store(skey_t *key, uint8_t *dst, size_t sz);
 void key_load(context_t *ctx, skey_t *key_out, uint8_t *src, size_t sz);
 
+// Public keys
+pkey_t *key_public_key(context_t *ctx, skey_t *key);
+void pkey_free(pkey_t *pk);
+
+size_t pkey_size(pkey_t *pk);
+void pkey_store(pkey_t *pk, uint8_t *dst, size_t sz);
+pkey_t *pkey_load(context_t *ctx, uint8_t *src, size_t sz);
+
+void pkey_encrypt(pkey_t *pk, plaintext_t *pt, ciphertext_t *ct);
+
 #ifdef __cplusplus
 }
 #endif
@@ -5,6 +5,7 @@
 #include <seal/seal.h>
 #include <assert.h>
 #include <cmath>
+#include <mutex>
 
 using namespace std;
 using namespace seal;
@@ -30,6 +31,30 @@ class CryptoContext {
     size_t logq;
 };
 
+// A source of randomness for SEAL that derives the seed of each PRNG it
+// creates from one master seed, so that (for a fixed order of calls) key
+// generation and encryption are deterministic. Only for tests.
+class SeededPRNGFactory : public UniformRandomGeneratorFactory {
+  public:
+    SeededPRNGFactory(prng_seed_type seed) :
+      UniformRandomGeneratorFactory(seed),
+      master(seed) {};
+
+    virtual ~SeededPRNGFactory() {};
+
+  protected:
+    shared_ptr<UniformRandomGenerator> create_impl(prng_seed_type) override {
+      prng_seed_type next;
+      lock_guard<mutex> lock(mu);
+      master.generate(sizeof(next), reinterpret_cast<seal_byte*>(next.data()));
+      return make_shared<Blake2xbPRNG>(next);
+    };
+
+  private:
+    mutex mu;
+    Blake2xbPRNG master;
+};
+
 class CryptoKey {
   public:
     CryptoKey(SEALContext &context) :
@@ -37,6 +62,11 @@ class CryptoKey {
       encryptor(context, sk),
       decryptor(context, sk) {};
 
+    CryptoKey(SEALContext &context, const SecretKey &sk_in) :
+      sk(sk_in),
+      encryptor(context, sk),
+      decryptor(context, sk) {};
+
     inline void set_key(SEALContext &context, uint8_t *src, size_t sz) {
       this->sk.load(context, (const seal_byte*) src, sz);
       new (&encryptor) Encryptor(context, this->sk);
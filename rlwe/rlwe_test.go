@@ -2,6 +2,7 @@ package rlwe
 
 import (
   "log"
+  "bytes"
   "testing"
   "math/rand"
 )
@@ -339,3 +340,108 @@ func TestCopy(t *testing.T) {
     }
   }
 }
+
+func TestDecryptTooNoisy(t *testing.T) {
+  ctx := NewContext()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  ct := NewCiphertext()
+  defer ct.Free()
+  key.EncryptSlice(ctx, randSlice(int(ctx.N()), ctx.P()), ct)
+
+  pt := NewPlaintext()
+  defer pt.Free()
+  pt.Set(ctx, randSlice(int(ctx.N()), ctx.P()))
+
+  // Each multiplication by a large plaintext grows the noise by roughly N*P
+  for i := 0; i < 4; i++ {
+    ct.MulPlain(ctx, pt)
+  }
+
+  out := NewPlaintext()
+  defer out.Free()
+  if key.Decrypt(ct, out) != ErrDecryptionFailed || key.NoiseBudget(ct) != 0 {
+    t.Fail()
+  }
+}
+
+// The noise budget shrinks as the noise grows, down to 0.
+func TestNoiseBudget(t *testing.T) {
+  ctx := NewContext()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  ct := NewCiphertext()
+  defer ct.Free()
+  key.EncryptSlice(ctx, randSlice(int(ctx.N()), ctx.P()), ct)
+  fresh := key.NoiseBudget(ct)
+  if fresh <= 0 {
+    t.Fatalf("Fresh ciphertext has budget %d", fresh)
+  }
+
+  // Doubling the ciphertext doubles the noise
+  ct.Add(ctx, ct)
+  if got := key.NoiseBudget(ct); got != fresh - 1 {
+    t.Fatalf("Budget went from %d to %d", fresh, got)
+  }
+
+  pt := NewPlaintext()
+  defer pt.Free()
+  pt.Set(ctx, randSlice(int(ctx.N()), ctx.P()))
+  ct.MulPlain(ctx, pt)
+  if got := key.NoiseBudget(ct); got >= fresh - 10 {
+    t.Fatalf("Budget went from %d to %d after a multiplication", fresh, got)
+  }
+}
+
+// The fused inner product computes exactly what the multiply-then-add
+// loop does, for ciphertexts in either form and in either context.
+func testInnerProductFused(t *testing.T, ctx *Context, useNTT bool) {
+  key := ctx.NewKey()
+  defer key.Free()
+
+  L := 300
+  cts := make([]*Ciphertext, L)
+  pts := make([]*Plaintext, L)
+  for i := 0; i < L; i++ {
+    cts[i] = NewCiphertext()
+    pts[i] = NewPlaintext()
+    defer cts[i].Free()
+    defer pts[i].Free()
+
+    key.EncryptSlice(ctx, randSlice(int(ctx.N()), 3), cts[i])
+    if useNTT {
+      cts[i].ToNTT(ctx)
+    }
+    pts[i].Set(ctx, randSlice(int(ctx.N()), 16))
+    pts[i].ToNTT(ctx)
+  }
+
+  got := NewCiphertext()
+  defer got.Free()
+  got.SetInnerProduct(ctx, cts, pts)
+
+  want := NewCiphertext()
+  defer want.Free()
+  want.setInnerProductReference(ctx, cts, pts)
+
+  if !bytes.Equal(got.Store(), want.Store()) {
+    t.Fatalf("Fused inner product differs (NTT form: %v)", useNTT)
+  }
+}
+
+func TestInnerProductFused(t *testing.T) {
+  ctx := NewContext()
+  defer ctx.Free()
+  testInnerProductFused(t, ctx, false)
+  testInnerProductFused(t, ctx, true)
+
+  pctx := NewContextPublic()
+  defer pctx.Free()
+  testInnerProductFused(t, pctx, false)
+}
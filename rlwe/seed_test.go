@@ -0,0 +1,155 @@
+package rlwe
+
+import (
+  "bytes"
+  "testing"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/binary"
+)
+
+// Encrypt 'vals' with a fresh key in a context seeded with 'seed', and
+// return the stored key and ciphertext.
+func seededRun(seed *Seed, vals []uint64) ([]byte, []byte) {
+  ctx := NewContextSeeded(seed)
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  return key.Store(), key.EncryptSquishedSlice(ctx, vals)
+}
+
+func TestSeededContext(t *testing.T) {
+  var seed, other Seed
+  seed[0] = 1
+  other[0] = 2
+
+  vals := make([]uint64, 2048)
+  for i := range vals {
+    vals[i] = uint64(i)
+  }
+
+  key1, ct1 := seededRun(&seed, vals)
+  key2, ct2 := seededRun(&seed, vals)
+  if !bytes.Equal(key1, key2) || !bytes.Equal(ct1, ct2) {
+    t.Fatal("Seeded context is not deterministic")
+  }
+
+  key3, ct3 := seededRun(&other, vals)
+  if bytes.Equal(key1, key3) || bytes.Equal(ct1, ct3) {
+    t.Fatal("Different seeds give the same output")
+  }
+
+  // Ciphertexts from a seeded context decrypt in an ordinary one
+  ctx := NewContext()
+  defer ctx.Free()
+  key := ctx.NewKey()
+  defer key.Free()
+  key.Load(ctx, key1)
+
+  ct := NewCiphertext()
+  defer ct.Free()
+  if err := ct.Load(ctx, ct1); err != nil {
+    t.Fatal(err)
+  }
+
+  pt := NewPlaintext()
+  defer pt.Free()
+  if err := key.Decrypt(ct, pt); err != nil {
+    t.Fatal(err)
+  }
+  out := make([]uint64, ctx.N())
+  pt.Dump(out)
+  for i := range vals {
+    if out[i] != vals[i] {
+      t.Fatalf("Decrypted %v, want %v", out[i], vals[i])
+    }
+  }
+}
+
+func TestKeyFromSeed(t *testing.T) {
+  seed := NewSeed()
+
+  // The same seed gives the same key, in any context
+  ctx1 := NewContext()
+  defer ctx1.Free()
+  var ctxSeed Seed
+  ctx2 := NewContextSeeded(&ctxSeed)
+  defer ctx2.Free()
+
+  key1 := ctx1.NewKeyFromSeed(seed)
+  defer key1.Free()
+  key2 := ctx2.NewKeyFromSeed(seed)
+  defer key2.Free()
+  if !bytes.Equal(key1.Store(), key2.Store()) {
+    t.Fatal("Keys from the same seed differ")
+  }
+
+  key3 := ctx1.NewKeyFromSeed(NewSeed())
+  defer key3.Free()
+  if bytes.Equal(key1.Store(), key3.Store()) {
+    t.Fatal("Keys from different seeds are equal")
+  }
+
+  // Encrypt under one key, and decrypt under the other
+  vals := randSlice(int(ctx1.N()), ctx1.P())
+  ct := NewCiphertext()
+  defer ct.Free()
+  key1.EncryptSlice(ctx1, vals, ct)
+
+  pt := NewPlaintext()
+  defer pt.Free()
+  if err := key2.Decrypt(ct, pt); err != nil {
+    t.Fatal(err)
+  }
+  out := make([]uint64, ctx1.N())
+  pt.Dump(out)
+  for i := range vals {
+    if out[i] != vals[i] {
+      t.Fatalf("Decrypted %v, want %v", out[i], vals[i])
+    }
+  }
+}
+
+// Golden vectors for NewKeyFromSeed, with the seed 0x00, 0x01, ..., 0x1f:
+// the SEAL PRNG seed that the KDF derives (which depends only on Go code),
+// and the SHA-256 digest of the stored key (which also depends on SEAL, so
+// it must be recorded on a build against SEAL 4.1, not a stand-in backend).
+// Until it is, the test checks only that the key is reproducible.
+const goldenPRNGSeed = "4a9894b5343393261fac3e1390801dc1602b7c2ede8938c1bc22b34072f9db36" +
+                       "4bf9b08be5526cb79193375eee7d1032335df57bd17ea2f3ae439c9394c1e7f8"
+const goldenKeySHA256 = ""
+
+func TestKeyFromSeedGolden(t *testing.T) {
+  var seed Seed
+  for i := range seed {
+    seed[i] = byte(i)
+  }
+
+  var buf []byte
+  for _, w := range expandSeed(&seed, "secret key") {
+    buf = binary.LittleEndian.AppendUint64(buf, w)
+  }
+  if got := hex.EncodeToString(buf); got != goldenPRNGSeed {
+    t.Fatalf("PRNG seed is %s, want %s", got, goldenPRNGSeed)
+  }
+
+  ctx := NewContext()
+  defer ctx.Free()
+  key := ctx.NewKeyFromSeed(&seed)
+  defer key.Free()
+
+  sum := sha256.Sum256(key.Store())
+  got := hex.EncodeToString(sum[:])
+  if goldenKeySHA256 == "" {
+    again := ctx.NewKeyFromSeed(&seed)
+    defer again.Free()
+    if !bytes.Equal(key.Store(), again.Store()) {
+      t.Fatal("Keys from the same seed differ")
+    }
+    t.Skipf("No key digest recorded: set goldenKeySHA256 to %s (on a SEAL build)", got)
+  } else if got != goldenKeySHA256 {
+    t.Fatalf("Key digest is %s, want %s", got, goldenKeySHA256)
+  }
+}
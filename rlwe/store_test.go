@@ -28,7 +28,9 @@ func TestCiphertextStore(t *testing.T) {
   byteArr := ct.Store()
   ct2 := NewCiphertext()
   defer ct2.Free()
-  ct2.Load(ctx, byteArr)
+  if err := ct2.Load(ctx, byteArr); err != nil {
+    t.Fatal(err)
+  }
 
   pt2 := NewPlaintext()
   defer pt2.Free()
@@ -84,3 +86,54 @@ func TestKeyStore(t *testing.T) {
     }
   }
 }
+
+func TestCiphertextLoadMalformed(t *testing.T) {
+  ctx := NewContext()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  ct := NewCiphertext()
+  defer ct.Free()
+
+  valid := key.EncryptSquishedSlice(ctx, make([]uint64, ctx.N()))
+  for _, in := range [][]byte{ nil, []byte{0}, valid[:len(valid)/2] } {
+    if ct.Load(ctx, in) != ErrMalformedCiphertext {
+      t.Fail()
+    }
+  }
+
+  // An NTT-form ciphertext is well-formed, but not a valid input
+  key.EncryptZero(ctx, ct)
+  ct.ToNTT(ctx)
+  if ct.Load(ctx, ct.Store()) != ErrMalformedCiphertext {
+    t.Fail()
+  }
+}
+
+func FuzzCiphertextLoad(f *testing.F) {
+  ctx := NewContext()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  ct := NewCiphertext()
+  defer ct.Free()
+
+  squished := key.EncryptSquishedSlice(ctx, make([]uint64, ctx.N()))
+  key.EncryptZero(ctx, ct)
+  f.Add(squished)
+  f.Add(ct.Store())
+  f.Add(squished[:64])
+
+  f.Fuzz(func(t *testing.T, in []byte) {
+    out := NewCiphertext()
+    defer out.Free()
+
+    if out.Load(ctx, in) == nil && out.Size() == 0 {
+      t.Fatal("Loaded an empty ciphertext")
+    }
+  })
+}
@@ -0,0 +1,172 @@
+package underhood
+
+import (
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+// A random hint with 'rows' rows, as wide as the SimplePIR secret, and its
+// decomposition.
+func benchHint[T matrix.Elem](p *params, rows uint64) *hintDecomp {
+  cols := lwe.NewParamsFixedP(T(0).Bitlen(), 1<<10, 512).N
+  hint := matrix.Rand[T](rand.NewRandomBufPRG(), rows, cols, 0)
+  return decomposeHint(p, hint, numLimbs[T]())
+}
+
+// The encrypted secret of a HintQuery, for a hint with 'cols' columns.
+func benchQuery(p *params, key *rlwe.Key, cols uint64) HintQuery {
+  vals := make([]uint64, p.ctx.N())
+  q := make(HintQuery, cols)
+  for i := range q {
+    vals[0] = uint64(i % (SecretMax + 1))
+    q[i] = key.EncryptSquishedSlice(p.ctx, vals)
+  }
+  return q
+}
+
+// One limb of a HintAnswer, with the encrypted secret in NTT form (as
+// applyHint prepares it) or in coefficient form (so that each inner
+// product transforms every ciphertext again).
+func benchmarkApplyHintOnce[T matrix.Elem](b *testing.B, ntt bool) {
+  p := newParams()
+  defer p.Free()
+
+  hint := benchHint[T](p, p.ctx.N())
+  defer hint.Free()
+
+  key := p.ctx.NewKey()
+  defer key.Free()
+
+  q := benchQuery(p, key, hint.cols)
+  encSk := make([]*rlwe.Ciphertext, len(q))
+  for i := range encSk {
+    encSk[i] = rlwe.NewCiphertext()
+    defer encSk[i].Free()
+    if err := encSk[i].Load(p.ctx, q[i]); err != nil {
+      b.Fatal(err)
+    }
+    if ntt {
+      encSk[i].ToNTT(p.ctx)
+    }
+  }
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    p.applyHintOnce(hint, encSk, 0)
+  }
+}
+
+func BenchmarkApplyHintOnceNTT64(b *testing.B) {
+  benchmarkApplyHintOnce[matrix.Elem64](b, true)
+}
+
+func BenchmarkApplyHintOnceCoeff64(b *testing.B) {
+  benchmarkApplyHintOnce[matrix.Elem64](b, false)
+}
+
+func BenchmarkApplyHintOnceNTT32(b *testing.B) {
+  benchmarkApplyHintOnce[matrix.Elem32](b, true)
+}
+
+func BenchmarkApplyHintOnceCoeff32(b *testing.B) {
+  benchmarkApplyHintOnce[matrix.Elem32](b, false)
+}
+
+// A whole HintAnswer (all limbs), from the serialized query.
+func benchmarkApplyHint[T matrix.Elem](b *testing.B) {
+  p := newParams()
+  defer p.Free()
+
+  hint := benchHint[T](p, p.ctx.N())
+  defer hint.Free()
+
+  key := p.ctx.NewKey()
+  defer key.Free()
+  q := benchQuery(p, key, hint.cols)
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := p.applyHint(hint, q); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkApplyHint64(b *testing.B) {
+  benchmarkApplyHint[matrix.Elem64](b)
+}
+
+func BenchmarkApplyHint32(b *testing.B) {
+  benchmarkApplyHint[matrix.Elem32](b)
+}
+
+// The AnswerMany that the blocked one replaces: one pass over the
+// squished database per column, in parallel (for comparison).
+func (s *Server[T]) answerManyReference(q *pir.Query[T]) *matrix.Matrix[T] {
+  k := q.Query.Cols()
+  cols := make([]*matrix.Matrix[T], k)
+  ch := make(chan int, k)
+
+  for j := uint64(0); j < k; j++ {
+    go func(j uint64) {
+      cols[j] = s.pirServer.Answer(&pir.Query[T]{ Query: getColumn(q.Query, j) }).Answer
+      ch <- 0
+    }(j)
+  }
+
+  for j := uint64(0); j < k; j++ {
+    <-ch
+  }
+
+  out := matrix.Zeros[T](cols[0].Rows(), k)
+  for j, col := range cols {
+    setColumn(out, uint64(j), col)
+  }
+  return out
+}
+
+// A server that can only answer queries (without the token setup, which
+// AnswerMany does not need).
+func answerOnlyServer[T matrix.Elem](db *pir.Database[T]) *Server[T] {
+  pirServer := pir.NewServerSeed(db, rand.RandomPRGKey())
+  return &Server[T]{ pirServer: pirServer, inner: simplePIRServer[T]{ Server: pirServer }, data: db.Data }
+}
+
+// An LHE query with 'k' columns to a database of 2^24 elements.
+func benchmarkAnswerMany[T matrix.Elem](b *testing.B, k uint64, reference bool) {
+  params := lwe.NewParamsFixedP(T(0).Bitlen(), 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[T](rand.NewRandomBufPRG(), 1<<24, 1, params)
+  server := answerOnlyServer(db)
+  info := server.pirServer.DBInfo()
+  rows := ((info.M + info.Squishing - 1) / info.Squishing) * info.Squishing
+  q := &pir.Query[T]{ Query: matrix.Rand[T](rand.NewRandomBufPRG(), rows, k, 0) }
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if reference {
+      server.answerManyReference(q)
+    } else if _, err := server.AnswerMany(q); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkAnswerMany64(b *testing.B) {
+  benchmarkAnswerMany[matrix.Elem64](b, 16, false)
+}
+
+func BenchmarkAnswerMany64Reference(b *testing.B) {
+  benchmarkAnswerMany[matrix.Elem64](b, 16, true)
+}
+
+func BenchmarkAnswerMany32(b *testing.B) {
+  benchmarkAnswerMany[matrix.Elem32](b, 16, false)
+}
+
+func BenchmarkAnswerMany32Reference(b *testing.B) {
+  benchmarkAnswerMany[matrix.Elem32](b, 16, true)
+}
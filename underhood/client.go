@@ -1,11 +1,16 @@
 package underhood
 
 import (
+  "errors"
   "github.com/henrycg/simplepir/matrix"
   "github.com/henrycg/simplepir/pir"
   "github.com/henrycg/simplepir/rand"
+  "github.com/ahenzinger/underhood/rlwe"
 )
 
+var ErrBadHintAnswer = errors.New("underhood: malformed hint answer")
+var ErrTokenUsed = errors.New("underhood: token was already used for a query")
+
 type KeyBlob = []byte
 
 type CipherBlob = []byte
@@ -18,88 +23,159 @@ type HintAnswer struct {
 }
 
 type Client[T matrix.Elem] struct {
-  params      *params
+  tokens      *TokenClient[T]
   pirClient   *pir.Client[T]
-
-  innerSecret *matrix.Matrix[T] 
-  outerSecret KeyBlob
+  delta       uint64 // SimplePIR plaintext multiplier
+  seeds       []rand.PRGKey
 
   interm      *matrix.Matrix[T]
   skLHE       *pir.SecretLHE[T]
+  skLHEMany   []*pir.SecretLHE[T]
   sk          *pir.Secret[T]
+
+  queried     bool // a query was built from the preprocessed secret
+  unsafeReuse bool
+
+  // The databases that the inner secret sharesFor serves (see share.go)
+  shares      *shareRecord
+  sharesFor   any
 }
 
 // WARNING: You must call Free() on this client to cleanup
+// Panics if the parameters are below the threshold set by SetMinSecurityBits.
 func NewClient[T matrix.Elem](matrixAseed *rand.PRGKey, dbinfo *pir.DBInfo) *Client[T] {
+  mustBeSecure(dbinfo.Params)
+  pirClient := pir.NewClient[T](nil, matrixAseed, dbinfo)
   return &Client[T]{
-    params: newParams(),
-    pirClient: pir.NewClient[T](nil, matrixAseed, dbinfo),
+    tokens: NewTokenClient[T](simplePIRClient[T]{ Client: pirClient }),
+    pirClient: pirClient,
+    delta: dbinfo.Params.Delta,
+    seeds: []rand.PRGKey{ *matrixAseed },
   }
 }
 
+// Output a client whose tokens are a deterministic function of 'seed':
+// the SimplePIR secrets, the RLWE key and the encryptions in HintQuery all
+// derive from it. (The SimplePIR query error does not.) This is for
+// reproducible tests only: anyone who knows the seed can decrypt.
+//
 // WARNING: You must call Free() on this client to cleanup
+func NewClientForTesting[T matrix.Elem](matrixAseed *rand.PRGKey, dbinfo *pir.DBInfo, seed *rlwe.Seed) *Client[T] {
+  mustBeSecure(dbinfo.Params)
+  pirClient := pir.NewClient[T](nil, matrixAseed, dbinfo)
+  inner := simplePIRClient[T]{
+    Client: pirClient,
+    prg: rand.NewBufPRG(rand.NewPRG(derivePRGKey(seed, "secrets"))),
+  }
+  return &Client[T]{
+    tokens: newTokenClientSeeded[T](inner, seed),
+    pirClient: pirClient,
+    delta: dbinfo.Params.Delta,
+    seeds: []rand.PRGKey{ *matrixAseed },
+  }
+}
+
+// WARNING: You must call Free() on this client to cleanup
+// Panics if the parameters are below the threshold set by SetMinSecurityBits.
 func NewClientDistributed[T matrix.Elem](matrixAseeds []rand.PRGKey, offsets []uint64, dbinfo *pir.DBInfo) *Client[T] {
+  mustBeSecure(dbinfo.Params)
+  pirClient := pir.NewClientDistributed[T](nil, matrixAseeds, offsets, dbinfo)
   return &Client[T]{
-    params: newParams(),
-    pirClient: pir.NewClientDistributed[T](nil, matrixAseeds, offsets, dbinfo),
+    tokens: NewTokenClient[T](simplePIRClient[T]{ Client: pirClient }),
+    pirClient: pirClient,
+    delta: dbinfo.Params.Delta,
+    seeds: append([]rand.PRGKey{}, matrixAseeds...),
   }
 }
 
 func (c *Client[T]) Free() {
-  c.params.Free()
+  c.tokens.Free()
 }
 
 func (c *Client[T]) HintQuery() *HintQuery {
-  var encSk HintQuery
-
-  c.innerSecret = c.pirClient.GenerateSecret()
-  c.outerSecret, encSk = c.encryptSecret(c.innerSecret)
-
-  return &encSk
+  return c.tokens.HintQuery(1)
 }
 
-func (c *Client[T]) CopySecret(oc *Client[matrix.Elem64]) {
-  switch v := any(c).(type) {
-  case *Client[matrix.Elem64]:
-    v.innerSecret = oc.innerSecret.Copy()
-
-  case *Client[matrix.Elem32]:
-    if oc.pirClient.GetSecurityParam() < v.pirClient.GetSecurityParam() {
-      panic("Invalid operation")
-    }
-    toDrop := oc.pirClient.GetSecurityParam() - v.pirClient.GetSecurityParam()
-
-    smallSecret := oc.innerSecret.Make32()
-    smallSecret.DropLastrows(toDrop)
-    v.innerSecret = smallSecret
-
-  default:
-    panic("Should not get here")
+func (c *Client[T]) checkSingleSecret() {
+  if c.tokens.innerSecret.Cols() != 1 {
+    panic("Token holds several secrets: use PreprocessQueryLHEMany")
   }
-
-  c.outerSecret = make([]byte, len(oc.outerSecret))
-  copy(c.outerSecret, oc.outerSecret)
 }
 
 func (c *Client[T]) PreprocessQuery() {
-  c.sk = c.pirClient.PreprocessQueryGivenSecret(c.innerSecret)
+  c.checkSingleSecret()
+  c.sk = c.pirClient.PreprocessQueryGivenSecret(c.tokens.innerSecret)
+  c.queried = false
 }
 
 func (c *Client[T]) PreprocessQueryLHE() {
-  c.skLHE = c.pirClient.PreprocessQueryLHEGivenSecret(c.innerSecret)
+  c.checkSingleSecret()
+  c.skLHE = c.pirClient.PreprocessQueryLHEGivenSecret(c.tokens.innerSecret)
+  c.queried = false
+}
+
+// Let the client build several queries from one preprocessed secret.
+//
+// UNSAFE: two queries built from the same secret reveal the difference of
+// the queried indices (or messages) to the server. Only use this for
+// benchmarks and tests.
+func (c *Client[T]) AllowUnsafeReuse() {
+  c.unsafeReuse = true
 }
 
-// Recover H.s
-func (c *Client[T]) HintRecover(ans *HintAnswer) {
-  c.interm = c.recoverAS(ans)
+// Mark the preprocessed secret as used. Each secret builds at most one
+// query (unless in unsafe mode); the client must fetch a new token
+// (HintQuery, HintRecover and PreprocessQuery) before the next query.
+func (c *Client[T]) use() error {
+  if c.queried && !c.unsafeReuse {
+    return ErrTokenUsed
+  }
+  c.queried = true
+  return nil
 }
 
-func (c *Client[T]) Query(q uint64) *pir.Query[T] {
-  return c.pirClient.QueryPreprocessed(q, c.sk)
+// Recover H.s. Returns an error (wrapping ErrBadHintAnswer) if the
+// server's answer is malformed.
+func (c *Client[T]) HintRecover(ans *HintAnswer) error {
+  interm, err := c.tokens.HintRecover(ans)
+  if err != nil {
+    return err
+  }
+  c.interm = interm
+  return nil
 }
 
-func (c *Client[T]) QueryLHE(q *matrix.Matrix[T]) *pir.Query[T] {
-  return c.pirClient.QueryLHEPreprocessed(q, c.skLHE)
+// Returns ErrTokenUsed if the preprocessed secret was already used.
+func (c *Client[T]) Query(q uint64) (*pir.Query[T], error) {
+  if c.sk == nil {
+    panic("Must call PreprocessQuery first")
+  }
+  if err := c.use(); err != nil {
+    return nil, err
+  }
+
+  // SimplePIR adds the query into the preprocessed secret in place: copy
+  // the query out, and undo the addition, so that the secret stays clean
+  // (even if the client later turns on unsafe reuse).
+  out := c.pirClient.QueryPreprocessed(q, c.sk)
+  copied := out.Query.Copy()
+  out.Query.AddAt(q % c.pirClient.GetM(), 0, T(0) - T(c.delta))
+  return &pir.Query[T]{ Query: copied }, nil
+}
+
+// Returns ErrTokenUsed if the preprocessed secret was already used.
+func (c *Client[T]) QueryLHE(q *matrix.Matrix[T]) (*pir.Query[T], error) {
+  if c.skLHE == nil {
+    panic("Must call PreprocessQueryLHE first")
+  }
+  if err := c.use(); err != nil {
+    return nil, err
+  }
+
+  out := c.pirClient.QueryLHEPreprocessed(q, c.skLHE)
+  copied := out.Query.Copy()
+  c.undoQueryLHE(out.Query, q)
+  return &pir.Query[T]{ Query: copied }, nil
 }
 
 func (c *Client[T]) Recover(ansIn *pir.Answer[T]) []uint64 {
@@ -113,3 +189,12 @@ func (c *Client[T]) RecoverLHE(ansIn *pir.Answer[T]) *matrix.Matrix[T] {
   ans.Sub(c.interm)
   return c.pirClient.DecodeManyLHE(ans)
 }
+
+// SimplePIR adds the message into the preprocessed secret in place: undo
+// this, so that the secret stays clean.
+func (c *Client[T]) undoQueryLHE(query, msgIn *matrix.Matrix[T]) {
+  msg := msgIn.Copy()
+  msg.MulConst(T(c.delta))
+  msg.AppendZeros(query.Rows() - msg.Rows())
+  query.Sub(msg)
+}
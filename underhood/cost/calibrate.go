@@ -0,0 +1,100 @@
+package cost
+
+import (
+  "time"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+// Number of terms in the inner product that Calibrate() times.
+const calibrationTerms = 64
+
+// Measure the per-operation costs on this machine, with micro-benchmarks
+// that each run for roughly 'budget'. Takes a few seconds.
+func Calibrate(budget time.Duration) *Calibration {
+  ctx := rlwe.NewContext()
+  defer ctx.Free()
+
+  key := ctx.NewKey()
+  defer key.Free()
+
+  n := ctx.N()
+  cal := &Calibration{
+    RingDegree: n,
+    KeyBytes: uint64(key.Size()),
+  }
+
+  vals := make([]uint64, n)
+  for i := range vals {
+    vals[i] = uint64(i) % 16
+  }
+  cal.SeededCiphertextBytes = uint64(len(key.EncryptSquishedSlice(ctx, vals)))
+
+  // Plaintext encoding, as in decomposeHint
+  pts := make([]*rlwe.Plaintext, calibrationTerms)
+  cts := make([]*rlwe.Ciphertext, calibrationTerms)
+  for i := range pts {
+    pts[i] = rlwe.NewPlaintext()
+    defer pts[i].Free()
+    cts[i] = rlwe.NewCiphertext()
+    defer cts[i].Free()
+  }
+
+  cal.PlaintextTime = timeOp(budget, func() {
+    for _, pt := range pts {
+      pt.Set(ctx, vals)
+      pt.ToNTT(ctx)
+    }
+  }, calibrationTerms)
+
+  // Inner products, as in applyHintOnce (which takes the encrypted secret
+  // in NTT form)
+  for _, ct := range cts {
+    key.EncryptSlice(ctx, vals, ct)
+    ct.ToNTT(ctx)
+  }
+  out := rlwe.NewCiphertext()
+  defer out.Free()
+
+  cal.MulAddTime = timeOp(budget, func() {
+    out.SetInnerProduct(ctx, cts, pts)
+  }, calibrationTerms)
+  cal.CiphertextBytes = uint64(len(out.Store()))
+
+  cal.AnswerWordTime32 = timeAnswer[matrix.Elem32](budget)
+  cal.AnswerWordTime64 = timeAnswer[matrix.Elem64](budget)
+
+  return cal
+}
+
+// Time of one SimplePIR Answer, per squished database word.
+func timeAnswer[T matrix.Elem](budget time.Duration) time.Duration {
+  const num = 1 << 20
+  params := lwe.NewParamsFixedP(T(0).Bitlen(), 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[T](rand.NewRandomBufPRG(), num, 9, params)
+  server := pir.NewServer(db)
+
+  seed := rand.RandomPRGKey()
+  client := pir.NewClient[T](nil, seed, db.Info)
+  _, q := client.Query(0)
+
+  words := db.Info.L * ((db.Info.M + squishRatio - 1) / squishRatio)
+  return timeOp(budget, func() {
+    server.Answer(q)
+  }, words)
+}
+
+// Run 'op' repeatedly for about 'budget', and return its time per unit of
+// work (where one call to 'op' does 'units' units).
+func timeOp(budget time.Duration, op func(), units uint64) time.Duration {
+  iters := 0
+  start := time.Now()
+  for iters == 0 || time.Since(start) < budget {
+    op()
+    iters += 1
+  }
+  return time.Since(start) / time.Duration(uint64(iters) * units)
+}
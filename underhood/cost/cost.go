@@ -0,0 +1,146 @@
+package cost
+
+import (
+  "fmt"
+  "time"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/ahenzinger/underhood/underhood"
+)
+
+// A cost model for the PIR scheme in underhood/: given the shape of a
+// database, it predicts the size of each message, the server's time for
+// each phase, and the client's memory, without running the protocol.
+// Message sizes follow exactly from the database shape and the size of
+// one RLWE ciphertext; times scale per-operation costs measured by
+// Calibrate() on the target machine.
+
+// SimplePIR packs this many database elements into each word (see
+// matrix/squish.h in the SimplePIR dependency).
+const squishRatio = 3
+
+type Config struct {
+  Num        uint64      // number of database elements
+  RecordBits uint64      // bits per element
+  ElemBits   uint64      // 32 or 64 (i.e., matrix.Elem32 or matrix.Elem64)
+  Params     *lwe.Params // LWE parameters (nil to choose them automatically)
+  Secrets    uint64      // secrets per token request (0 means 1)
+}
+
+// Per-operation costs, measured by Calibrate().
+type Calibration struct {
+  RingDegree            uint64 // RLWE ring dimension
+  SeededCiphertextBytes uint64 // one encrypted secret value, in a HintQuery
+  CiphertextBytes       uint64 // one ciphertext, in a HintAnswer
+  KeyBytes              uint64 // the client's RLWE secret key
+
+  PlaintextTime         time.Duration // encode (and NTT) one hint plaintext
+  MulAddTime            time.Duration // one ciphertext-plaintext product in an inner product
+  AnswerWordTime32      time.Duration // one squished database word in Answer (32-bit)
+  AnswerWordTime64      time.Duration // one squished database word in Answer (64-bit)
+}
+
+// Defaults for the BFV parameters in rlwe/rlwe.cpp (N = 2048, one 38-bit
+// modulus, stored uncompressed as 64-bit words): a ciphertext holds two
+// polynomials, a seeded ciphertext holds one (plus a seed), and the key
+// holds one. The byte counts include an approximate 128-byte header. The
+// times are rough single-core figures; use Calibrate() for real numbers.
+func DefaultCalibration() *Calibration {
+  n := uint64(2048)
+  return &Calibration{
+    RingDegree: n,
+    SeededCiphertextBytes: 8*n + 128,
+    CiphertextBytes: 2*8*n + 128,
+    KeyBytes: 8*n + 128,
+    PlaintextTime: 20*time.Microsecond,
+    MulAddTime: 10*time.Microsecond,
+    AnswerWordTime32: time.Nanosecond,
+    AnswerWordTime64: time.Nanosecond,
+  }
+}
+
+type Estimate struct {
+  Info *pir.DBInfo
+
+  // Upload, in bytes
+  HintQueryBytes  uint64
+  QueryBytes      uint64
+
+  // Download, in bytes
+  HintAnswerBytes uint64
+  AnswerBytes     uint64
+
+  // Server time, on one core (HintAnswer runs in parallel across rows)
+  PreprocessTime  time.Duration // decompose the hint, once per database
+  HintAnswerTime  time.Duration // per token
+  AnswerTime      time.Duration // per query
+
+  // Client memory for one token: the secrets, the RLWE key, the
+  // recovered hint product, and the preprocessed query.
+  ClientBytes     uint64
+}
+
+func numLimbs(elemBits uint64) uint64 {
+  switch elemBits {
+  case 32:
+    return underhood.NumLimbs32
+  case 64:
+    return underhood.NumLimbs64
+  default:
+    panic("Should not reach")
+  }
+}
+
+// Predict the costs of serving the database described by 'cfg'.
+func Predict(cfg Config, cal *Calibration) (*Estimate, error) {
+  if cfg.ElemBits != 32 && cfg.ElemBits != 64 {
+    return nil, fmt.Errorf("cost: ElemBits must be 32 or 64, got %d", cfg.ElemBits)
+  }
+  if cfg.Num == 0 || cfg.RecordBits == 0 {
+    return nil, fmt.Errorf("cost: empty database")
+  }
+  if cal == nil {
+    cal = DefaultCalibration()
+  }
+
+  var info *pir.DBInfo
+  if cfg.Params == nil {
+    info = pir.NewDBInfo(cfg.ElemBits, cfg.Num, cfg.RecordBits)
+  } else {
+    info = pir.NewDBInfoFixedParams(cfg.Num, cfg.RecordBits, cfg.Params, true)
+  }
+
+  k := cfg.Secrets
+  if k == 0 {
+    k = 1
+  }
+
+  elemBytes := cfg.ElemBits / 8
+  limbs := numLimbs(cfg.ElemBits)
+  secretDim := info.Params.N
+  cts := (info.L + cal.RingDegree - 1) / cal.RingDegree     // ciphertexts per limb
+  words := (info.M + squishRatio - 1) / squishRatio         // squished columns
+  queryRows := words * squishRatio
+
+  e := &Estimate{ Info: info }
+  e.HintQueryBytes = k * secretDim * cal.SeededCiphertextBytes
+  e.QueryBytes = queryRows * elemBytes
+  e.HintAnswerBytes = k * limbs * cts * cal.CiphertextBytes
+  e.AnswerBytes = info.L * elemBytes
+
+  e.PreprocessTime = time.Duration(limbs * cts * secretDim) * cal.PlaintextTime
+  e.HintAnswerTime = time.Duration(k * limbs * cts * secretDim) * cal.MulAddTime
+
+  wordTime := cal.AnswerWordTime64
+  if cfg.ElemBits == 32 {
+    wordTime = cal.AnswerWordTime32
+  }
+  e.AnswerTime = time.Duration(info.L * words) * wordTime
+
+  e.ClientBytes = k * secretDim * elemBytes +    // SimplePIR secrets
+                  cal.KeyBytes +                 // RLWE key
+                  k * info.L * elemBytes +       // H x s
+                  2 * queryRows * elemBytes      // preprocessed query and its error
+
+  return e, nil
+}
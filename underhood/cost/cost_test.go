@@ -0,0 +1,108 @@
+package cost
+
+import (
+  "time"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/underhood"
+)
+
+func TestPredictShape(t *testing.T) {
+  cal := DefaultCalibration()
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  e, err := Predict(Config{ Num: 1<<20, RecordBits: 9, ElemBits: 64, Params: params }, cal)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  info := e.Info
+  cts := (info.L + cal.RingDegree - 1) / cal.RingDegree
+  if e.HintAnswerBytes != underhood.NumLimbs64 * cts * cal.CiphertextBytes {
+    t.Errorf("HintAnswer: %v bytes", e.HintAnswerBytes)
+  }
+  if e.HintQueryBytes != info.Params.N * cal.SeededCiphertextBytes {
+    t.Errorf("HintQuery: %v bytes", e.HintQueryBytes)
+  }
+  if e.QueryBytes < 8 * info.M || e.QueryBytes >= 8 * (info.M + squishRatio) {
+    t.Errorf("Query: %v bytes", e.QueryBytes)
+  }
+  if e.AnswerBytes != 8 * info.L {
+    t.Errorf("Answer: %v bytes", e.AnswerBytes)
+  }
+
+  // Several secrets scale the token, but not the query
+  e2, _ := Predict(Config{ Num: 1<<20, RecordBits: 9, ElemBits: 64, Params: params, Secrets: 3 }, cal)
+  if e2.HintAnswerBytes != 3 * e.HintAnswerBytes || e2.HintAnswerTime != 3 * e.HintAnswerTime ||
+     e2.QueryBytes != e.QueryBytes {
+    t.Error("Secrets do not scale as expected")
+  }
+
+  if _, err := Predict(Config{ Num: 1, RecordBits: 1, ElemBits: 16 }, cal); err == nil {
+    t.Error("Expected an error")
+  }
+}
+
+// Check the predicted message sizes against a real run of the protocol.
+func TestPredictSizes(t *testing.T) {
+  cal := Calibrate(10*time.Millisecond)
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 9, params)
+  e, err := Predict(Config{ Num: 1<<12, RecordBits: 9, ElemBits: 64, Params: params }, cal)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  seed := rand.RandomPRGKey()
+  server := underhood.NewServer(db, seed)
+  defer server.Free()
+  client := underhood.NewClient[matrix.Elem64](seed, db.Info)
+  defer client.Free()
+
+  hq := client.HintQuery()
+  if got := blobBytes(*hq); got != e.HintQueryBytes {
+    t.Errorf("HintQuery: got %v bytes, predicted %v", got, e.HintQueryBytes)
+  }
+
+  ha, err := server.HintAnswer(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  got := uint64(0)
+  for _, lst := range ha.HintCts {
+    got += blobBytes(lst)
+  }
+  if got != e.HintAnswerBytes {
+    t.Errorf("HintAnswer: got %v bytes, predicted %v", got, e.HintAnswerBytes)
+  }
+
+  if err := client.HintRecover(ha); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+  q, err := client.Query(0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := 8 * q.Query.Rows(); got != e.QueryBytes {
+    t.Errorf("Query: got %v bytes, predicted %v", got, e.QueryBytes)
+  }
+
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := 8 * ans.Answer.Rows(); got != e.AnswerBytes {
+    t.Errorf("Answer: got %v bytes, predicted %v", got, e.AnswerBytes)
+  }
+}
+
+func blobBytes(blobs []underhood.CipherBlob) uint64 {
+  out := uint64(0)
+  for _, b := range blobs {
+    out += uint64(len(b))
+  }
+  return out
+}
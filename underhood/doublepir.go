@@ -0,0 +1,249 @@
+package underhood
+
+import (
+  "fmt"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/rand"
+)
+
+// DoublePIR runs SimplePIR twice: once over the columns of the database D
+// (L x M), then over the rows of the first answer and of the first hint
+// H1 = D x A1, with each of their entries decomposed into kappa base-p
+// digits. Its client needs only H2 x s2, for its second secret s2 and
+//   H2 = Decomp(H1)^T x A2,
+// which has kappa*n rows and n columns: the client gets row i of H1 in the
+// answer, and multiplies it with its first secret s1 itself. So one token
+// per query, for H2 x s2, stands in for the download of H2.
+//
+// This is the plain scheme, to run the token protocol over a second inner
+// scheme: it holds one element per entry of D, and does not compress the
+// answer. DoublePIRServer and DoublePIRClient implement InnerServer and
+// InnerClient.
+
+// The parameters of DoublePIR for the token protocol.
+type doublePIRParams[T matrix.Elem] struct {
+  params *lwe.Params
+}
+
+// The fewest limbs for which the error from the dropped ones (up to
+// n x SecretMax x 2^(dropped bits)) stays below Delta/4. The rest of the
+// noise budget is left to the LWE error (see checkDoublePIRParams).
+func (p doublePIRParams[T]) HintLimbs() int {
+  bits := T(0).Bitlen()
+  limbs := int(bits/BitsPerLimb)
+  for limbs > 1 {
+    dropped := bits - uint64((limbs-1)*BitsPerLimb)
+    if (p.params.Delta/4) >> dropped < p.params.N * SecretMax {
+      break
+    }
+    limbs--
+  }
+  return limbs
+}
+
+// Ternary secrets, as in SimplePIR.
+func (p doublePIRParams[T]) SecretBounds() (uint64, uint64) {
+  return SecretMin, SecretMax
+}
+
+// Number of base-p digits of an element of type T.
+func numDigits[T matrix.Elem](p uint64) uint64 {
+  kappa := uint64(0)
+  for v := uint64(T(0) - 1); v > 0; v /= p {
+    kappa++
+  }
+  return kappa
+}
+
+// Decompose each entry of 'm' into base-p digits, and transpose: entry
+// (j*kappa + t, r) of the output is digit t of entry (r, j) of 'm'.
+func decomposeTranspose[T matrix.Elem](m *matrix.Matrix[T], p uint64) *matrix.Matrix[T] {
+  kappa := numDigits[T](p)
+  out := matrix.New[T](m.Cols()*kappa, m.Rows())
+  for r := uint64(0); r < m.Rows(); r++ {
+    for j := uint64(0); j < m.Cols(); j++ {
+      v := uint64(m.Get(r, j))
+      for t := uint64(0); t < kappa; t++ {
+        out.Set(j*kappa + t, r, T(v % p))
+        v /= p
+      }
+    }
+  }
+  return out
+}
+
+// Decrypt the 'kappa' digits at rows [off, off+kappa) of 'm' (after the
+// secret part is subtracted), and put them back together.
+func (p doublePIRParams[T]) recompose(m *matrix.Matrix[T], off uint64) T {
+  kappa := numDigits[T](p.params.P)
+  val := T(0)
+  pow := T(1)
+  for t := uint64(0); t < kappa; t++ {
+    val += T(p.params.Round(uint64(m.Get(off + t, 0)))) * pow
+    pow *= T(p.params.P)
+  }
+  return val
+}
+
+// The second level's noise budget loses Delta/4 to the token (see
+// HintLimbs), so it needs twice the margin: since the noise grows with the
+// square root of the number of samples, L may be at most M/4 of the LWE
+// parameters.
+func checkDoublePIRParams[T matrix.Elem](params *lwe.Params, l, m uint64) {
+  if params.Logq != T(0).Bitlen() {
+    panic("LWE parameters do not match the element type")
+  }
+  if l == 0 || m == 0 || m > params.M || 4*l > params.M {
+    panic("Database is too large for the LWE parameters")
+  }
+}
+
+// The public matrices A1 (M x n) and A2 (L x n).
+func doublePIRMatrices[T matrix.Elem](params *lwe.Params, l, m uint64, seed *rand.PRGKey) (*matrix.Matrix[T], *matrix.Matrix[T]) {
+  prg := rand.NewBufPRG(rand.NewPRG(seed))
+  a1 := matrix.Rand[T](prg, m, params.N, 0)
+  a2 := matrix.Rand[T](prg, l, params.N, 0)
+  return a1, a2
+}
+
+type DoublePIRServer[T matrix.Elem] struct {
+  doublePIRParams[T]
+  db   *matrix.Matrix[T] // L x M, entries in [0, p)
+  a2   *matrix.Matrix[T]
+  h1   *matrix.Matrix[T] // Decomp(D x A1)^T: (kappa n) x L
+  hint *matrix.Matrix[T] // H2
+}
+
+type DoublePIRClient[T matrix.Elem] struct {
+  doublePIRParams[T]
+  l, m   uint64
+  a1, a2 *matrix.Matrix[T]
+  prg    *rand.BufPRGReader
+}
+
+type DoublePIRQuery[T matrix.Elem] struct {
+  Q1 *matrix.Matrix[T] // A1 x s1 + e1 + Delta x (column of the element)
+  Q2 *matrix.Matrix[T] // A2 x s2 + e2 + Delta x (row of the element)
+}
+
+type DoublePIRAnswer[T matrix.Elem] struct {
+  H *matrix.Matrix[T] // Decomp(H1)^T x Q2
+  A *matrix.Matrix[T] // Decomp(D x Q1)^T x A2
+  V *matrix.Matrix[T] // Decomp(D x Q1)^T x Q2
+}
+
+type DoublePIRSecret[T matrix.Elem] struct {
+  s1, s2 *matrix.Matrix[T]
+  index  uint64
+}
+
+// Panics if the database (L x M, with entries mod p) is too large for the
+// LWE parameters.
+func NewDoublePIRServer[T matrix.Elem](params *lwe.Params, db *matrix.Matrix[T], seed *rand.PRGKey) *DoublePIRServer[T] {
+  checkDoublePIRParams[T](params, db.Rows(), db.Cols())
+  a1, a2 := doublePIRMatrices[T](params, db.Rows(), db.Cols(), seed)
+  h1 := decomposeTranspose(matrix.Mul(db, a1), params.P)
+  return &DoublePIRServer[T]{
+    doublePIRParams: doublePIRParams[T]{ params },
+    db: db,
+    a2: a2,
+    h1: h1,
+    hint: matrix.Mul(h1, a2),
+  }
+}
+
+func (s *DoublePIRServer[T]) Hint() *matrix.Matrix[T] {
+  return s.hint
+}
+
+func (s *DoublePIRServer[T]) Answer(q *DoublePIRQuery[T]) (*DoublePIRAnswer[T], error) {
+  if q == nil || q.Q1 == nil || q.Q2 == nil {
+    return nil, fmt.Errorf("%w: missing", ErrBadQuery)
+  }
+  if q.Q1.Rows() != s.db.Cols() || q.Q1.Cols() != 1 || q.Q2.Rows() != s.db.Rows() || q.Q2.Cols() != 1 {
+    return nil, fmt.Errorf("%w: got %dx%d and %dx%d, want %dx1 and %dx1", ErrBadQuery,
+                           q.Q1.Rows(), q.Q1.Cols(), q.Q2.Rows(), q.Q2.Cols(), s.db.Cols(), s.db.Rows())
+  }
+
+  ans1 := decomposeTranspose(matrix.Mul(s.db, q.Q1), s.params.P)
+  return &DoublePIRAnswer[T]{
+    H: matrix.Mul(s.h1, q.Q2),
+    A: matrix.Mul(ans1, s.a2),
+    V: matrix.Mul(ans1, q.Q2),
+  }, nil
+}
+
+// The client of an L x M database, with the server's seed for A1 and A2.
+func NewDoublePIRClient[T matrix.Elem](params *lwe.Params, l, m uint64, seed *rand.PRGKey) *DoublePIRClient[T] {
+  checkDoublePIRParams[T](params, l, m)
+  a1, a2 := doublePIRMatrices[T](params, l, m, seed)
+  return &DoublePIRClient[T]{
+    doublePIRParams: doublePIRParams[T]{ params },
+    l: l,
+    m: m,
+    a1: a1,
+    a2: a2,
+    prg: rand.NewRandomBufPRG(),
+  }
+}
+
+func (c *DoublePIRClient[T]) GenerateSecret() *matrix.Matrix[T] {
+  return matrix.Ternary[T](c.prg, c.params.N, 1)
+}
+
+func (c *DoublePIRClient[T]) HintRows() uint64 {
+  return numDigits[T](c.params.P) * c.params.N
+}
+
+// Query for element i (at row i/M and column i%M of the database), under
+// the secret s2 of a token (TokenClient.Secret). Each token must serve
+// only one query.
+func (c *DoublePIRClient[T]) Query(i uint64, s2 *matrix.Matrix[T]) (*DoublePIRSecret[T], *DoublePIRQuery[T]) {
+  if i >= c.l*c.m {
+    panic("Index out of range")
+  }
+  if s2.Rows() != c.params.N || s2.Cols() != 1 {
+    panic("Secret has wrong dimensions")
+  }
+
+  s1 := c.GenerateSecret()
+  q1 := matrix.Mul(c.a1, s1)
+  q1.Add(matrix.Gaussian[T](c.prg, c.m, 1))
+  q1.AddAt(i % c.m, 0, T(c.params.Delta))
+
+  q2 := matrix.Mul(c.a2, s2)
+  q2.Add(matrix.Gaussian[T](c.prg, c.l, 1))
+  q2.AddAt(i / c.m, 0, T(c.params.Delta))
+
+  return &DoublePIRSecret[T]{ s1: s1, s2: s2, index: i }, &DoublePIRQuery[T]{ Q1: q1, Q2: q2 }
+}
+
+// Recover the element from the answer, given H2 x s2 from the token
+// (TokenClient.HintRecover).
+func (c *DoublePIRClient[T]) Recover(sec *DoublePIRSecret[T], hs *matrix.Matrix[T], ans *DoublePIRAnswer[T]) uint64 {
+  kappa := numDigits[T](c.params.P)
+  n := c.params.N
+  if hs.Rows() != kappa*n || hs.Cols() != 1 ||
+     ans.H.Rows() != kappa*n || ans.H.Cols() != 1 ||
+     ans.A.Rows() != kappa || ans.A.Cols() != n ||
+     ans.V.Rows() != kappa || ans.V.Cols() != 1 {
+    panic("Answer has wrong dimensions")
+  }
+
+  // Row i/M of H1
+  h := ans.H.Copy()
+  h.Sub(hs)
+  row := matrix.New[T](1, n)
+  for j := uint64(0); j < n; j++ {
+    row.Set(0, j, c.recompose(h, j*kappa))
+  }
+
+  // Entry i/M of D x Q1
+  v := ans.V.Copy()
+  v.Sub(matrix.Mul(ans.A, sec.s2))
+  val := c.recompose(v, 0)
+
+  val -= matrix.Mul(row, sec.s1).Get(0, 0)
+  return c.params.Round(uint64(val))
+}
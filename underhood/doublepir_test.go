@@ -0,0 +1,53 @@
+package underhood
+
+import (
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// DoublePIR queries round-trip, with H2 x s2 from a token.
+func testDoublePIR[T matrix.Elem](t *testing.T) {
+  const L, M = 64, 256
+  params := lwe.NewParams(T(0).Bitlen(), 4*L)
+  db := matrix.Rand[T](rand.NewRandomBufPRG(), L, M, params.P)
+  seed := rand.RandomPRGKey()
+
+  server := NewDoublePIRServer[T](params, db, seed)
+  client := NewDoublePIRClient[T](params, L, M, seed)
+
+  tokenServer := NewTokenServer[T](server)
+  defer tokenServer.Free()
+  tokenClient := NewTokenClient[T](client)
+  defer tokenClient.Free()
+
+  for _, i := range []uint64{ 0, 1, M + 7, L*M - 1 } {
+    hintAns, err := tokenServer.HintAnswer(tokenClient.HintQuery(1))
+    if err != nil {
+      t.Fatal(err)
+    }
+    hs, err := tokenClient.HintRecover(hintAns)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    sec, q := client.Query(i, tokenClient.Secret())
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if got, want := client.Recover(sec, hs, ans), uint64(db.Get(i / M, i % M)); got != want {
+      t.Fatalf("Element %d: got %d, want %d", i, got, want)
+    }
+  }
+}
+
+func TestDoublePIR64(t *testing.T) {
+  testDoublePIR[matrix.Elem64](t)
+}
+
+func TestDoublePIR32(t *testing.T) {
+  testDoublePIR[matrix.Elem32](t)
+}
@@ -0,0 +1,182 @@
+package underhood
+
+import (
+  "math"
+  "errors"
+  "math/big"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// Helpers to encode signed integers and fixed-point reals as LHE messages
+// (values mod p), and to decode the results of RecoverLHE.
+//
+// A value v mod p represents the signed integer in the centered range
+// [-floor(p/2), ceil(p/2)-1] that is congruent to v. Because p divides
+// the LWE modulus, the homomorphic matrix-vector product respects this
+// representation, as long as the true (signed) result does not wrap
+// around mod p. CheckInnerProduct checks this ahead of time.
+
+var ErrOutOfRange = errors.New("underhood: value does not fit in the plaintext space")
+var ErrOverflow = errors.New("underhood: inner product may wrap around mod p")
+
+func minSigned(p uint64) int64 {
+  return -int64(p/2)
+}
+
+func maxSigned(p uint64) int64 {
+  return int64(p - p/2) - 1
+}
+
+// Represent the signed value v mod p.
+func EncodeSigned(p uint64, v int64) (uint64, error) {
+  if v < minSigned(p) || v > maxSigned(p) {
+    return 0, ErrOutOfRange
+  }
+
+  if v < 0 {
+    return uint64(int64(p) + v), nil
+  }
+  return uint64(v), nil
+}
+
+// Interpret v mod p as a signed value in the centered range.
+func DecodeSigned(p uint64, v uint64) int64 {
+  v %= p
+  if v > uint64(maxSigned(p)) {
+    return int64(v) - int64(p)
+  }
+  return int64(v)
+}
+
+// Encode a vector of signed values as a column vector mod p.
+func EncodeSignedVector[T matrix.Elem](p uint64, vals []int64) (*matrix.Matrix[T], error) {
+  out := matrix.Zeros[T](uint64(len(vals)), 1)
+  for i, v := range vals {
+    e, err := EncodeSigned(p, v)
+    if err != nil {
+      return nil, err
+    }
+    out.Set(uint64(i), 0, T(e))
+  }
+  return out, nil
+}
+
+// Decode a column vector mod p (e.g., the output of RecoverLHE) as signed values.
+func DecodeSignedVector[T matrix.Elem](p uint64, m *matrix.Matrix[T]) []int64 {
+  if m.Cols() != 1 {
+    panic("Not a column vector")
+  }
+
+  out := make([]int64, m.Rows())
+  for i := range out {
+    out[i] = DecodeSigned(p, uint64(m.Get(uint64(i), 0)))
+  }
+  return out
+}
+
+// Fixed-point encoding: the real x is represented by the signed
+// integer round(x * Scale).
+type FixedPoint struct {
+  Scale float64
+}
+
+func (f FixedPoint) Encode(p uint64, x float64) (uint64, error) {
+  v := math.Round(x * f.Scale)
+  if v < float64(minSigned(p)) || v > float64(maxSigned(p)) {
+    return 0, ErrOutOfRange
+  }
+  return EncodeSigned(p, int64(v))
+}
+
+func (f FixedPoint) Decode(p uint64, v uint64) float64 {
+  return float64(DecodeSigned(p, v)) / f.Scale
+}
+
+// Multiplying values encoded with scales s1 and s2 gives a value
+// encoded with scale s1 * s2.
+func (f FixedPoint) Mul(g FixedPoint) FixedPoint {
+  return FixedPoint{ Scale: f.Scale * g.Scale }
+}
+
+func EncodeFixedVector[T matrix.Elem](p uint64, f FixedPoint, vals []float64) (*matrix.Matrix[T], error) {
+  out := matrix.Zeros[T](uint64(len(vals)), 1)
+  for i, x := range vals {
+    e, err := f.Encode(p, x)
+    if err != nil {
+      return nil, err
+    }
+    out.Set(uint64(i), 0, T(e))
+  }
+  return out, nil
+}
+
+func DecodeFixedVector[T matrix.Elem](p uint64, f FixedPoint, m *matrix.Matrix[T]) []float64 {
+  ints := DecodeSignedVector(p, m)
+  out := make([]float64, len(ints))
+  for i, v := range ints {
+    out[i] = float64(v) / f.Scale
+  }
+  return out
+}
+
+// Range of the database entries, when interpreted as signed values mod p.
+func SignedRange[T matrix.Elem](db *pir.Database[T]) (int64, int64) {
+  p := db.Info.P()
+  lo := int64(math.MaxInt64)
+  hi := int64(math.MinInt64)
+  for _, v := range db.Data.Data() {
+    s := DecodeSigned(p, uint64(v))
+    if s < lo {
+      lo = s
+    }
+    if s > hi {
+      hi = s
+    }
+  }
+  return lo, hi
+}
+
+// Check that, for any database with dimensions 'info' and entries in
+// [dbMin, dbMax], and for any message with entries in [msgMin, msgMax],
+// every entry of the database-message product lies in the centered range
+// mod p, so that DecodeSignedVector recovers it exactly.
+func CheckInnerProduct(info *pir.DBInfo, dbMin, dbMax, msgMin, msgMax int64) error {
+  if dbMin > dbMax || msgMin > msgMax {
+    panic("Invalid range")
+  }
+
+  p := info.P()
+  for _, v := range []int64{ dbMin, dbMax, msgMin, msgMax } {
+    if v < minSigned(p) || v > maxSigned(p) {
+      return ErrOutOfRange
+    }
+  }
+
+  // Each term of the inner product lies between the smallest and
+  // largest products of the range endpoints.
+  lo := new(big.Int)
+  hi := new(big.Int)
+  first := true
+  for _, d := range []int64{ dbMin, dbMax } {
+    for _, m := range []int64{ msgMin, msgMax } {
+      prod := new(big.Int).Mul(big.NewInt(d), big.NewInt(m))
+      if first || prod.Cmp(lo) < 0 {
+        lo.Set(prod)
+      }
+      if first || prod.Cmp(hi) > 0 {
+        hi.Set(prod)
+      }
+      first = false
+    }
+  }
+
+  cols := new(big.Int).SetUint64(info.M)
+  lo.Mul(lo, cols)
+  hi.Mul(hi, cols)
+
+  if lo.Cmp(big.NewInt(minSigned(p))) < 0 || hi.Cmp(big.NewInt(maxSigned(p))) > 0 {
+    return ErrOverflow
+  }
+  return nil
+}
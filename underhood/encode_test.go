@@ -0,0 +1,138 @@
+package underhood
+
+import (
+  "math"
+  "testing"
+  mrand "math/rand"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func TestSigned(t *testing.T) {
+  for _, p := range []uint64{ 5, 512, 991 } {
+    for v := minSigned(p); v <= maxSigned(p); v++ {
+      e, err := EncodeSigned(p, v)
+      if err != nil || e >= p || DecodeSigned(p, e) != v {
+        t.Fatalf("p=%v: %v does not round-trip", p, v)
+      }
+    }
+
+    if _, err := EncodeSigned(p, minSigned(p)-1); err != ErrOutOfRange {
+      t.Fail()
+    }
+    if _, err := EncodeSigned(p, maxSigned(p)+1); err != ErrOutOfRange {
+      t.Fail()
+    }
+  }
+}
+
+func TestFixedPoint(t *testing.T) {
+  f := FixedPoint{ Scale: 16 }
+  vals := []float64{ 0, 1.5, -2.25, 7.9, -7.9 }
+  m, err := EncodeFixedVector[matrix.Elem64](512, f, vals)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for i, x := range DecodeFixedVector(512, f, m) {
+    if math.Abs(x - vals[i]) > 0.5/f.Scale {
+      t.Errorf("%v vs. %v", x, vals[i])
+    }
+  }
+
+  if _, err := f.Encode(512, 16); err != ErrOutOfRange {
+    t.Fail()
+  }
+}
+
+func TestCheckInnerProduct(t *testing.T) {
+  params := lwe.NewParamsFixedP(64, 1<<10, 1<<17)
+  info := pir.NewDBInfoFixedParams(1<<10, 17, params, true)
+
+  // 1024 * 8 * 7 < 2^16
+  if CheckInnerProduct(info, -8, 7, -7, 7) != nil {
+    t.Fail()
+  }
+
+  // 1024 * 8 * 8 = 2^16
+  if CheckInnerProduct(info, -8, 7, -8, 8) != ErrOverflow {
+    t.Fail()
+  }
+
+  if CheckInnerProduct(info, 0, 1<<16, 0, 1) != ErrOutOfRange {
+    t.Fail()
+  }
+}
+
+func testLHESigned[IntT matrix.Elem](t *testing.T, dbSize, nSamples uint64, logP uint64, bound int64) {
+  pMod := uint64(1) << logP
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), nSamples, pMod)
+  r := mrand.New(mrand.NewSource(99))
+
+  vals := make([]uint64, dbSize)
+  for i := range vals {
+    vals[i], _ = EncodeSigned(pMod, r.Int63n(2*bound+1) - bound)
+  }
+  db := pir.NewDatabaseFixedParams[IntT](dbSize, logP, vals, params)
+
+  lo, hi := SignedRange(db)
+  if CheckInnerProduct(db.Info, lo, hi, -bound, bound) != nil {
+    t.Fatal("Inner product may overflow")
+  }
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  client := NewClient[IntT](seed, db.Info)
+  defer client.Free()
+
+  hq := client.HintQuery()
+  hans, err := server.HintAnswer(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQueryLHE()
+
+  in := make([]int64, db.Info.M)
+  for i := range in {
+    in[i] = r.Int63n(2*bound+1) - bound
+  }
+  msg, err := EncodeSignedVector[IntT](pMod, in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  q, err := client.QueryLHE(msg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  out := DecodeSignedVector(pMod, client.RecoverLHE(ans))
+
+  for row := range out {
+    expected := int64(0)
+    for col := uint64(0); col < db.Info.M; col++ {
+      expected += DecodeSigned(pMod, uint64(db.Data.Get(uint64(row), col))) * in[col]
+    }
+    if out[row] != expected {
+      t.Errorf("[%v] %v vs. %v", row, out[row], expected)
+    }
+  }
+}
+
+func TestEncryptionSigned64(t *testing.T) {
+  testLHESigned[matrix.Elem64](t, 1<<16, 1<<10, 17, 7)
+}
+
+func TestEncryptionSigned32(t *testing.T) {
+  testLHESigned[matrix.Elem32](t, 1<<16, 1<<7, 9, 1)
+}
@@ -0,0 +1,169 @@
+package underhood
+
+import (
+  "math"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// Analysis of the probability that a query returns a wrong answer. A query
+// can fail in two places:
+// 1) Decrypting the token. Each limb ciphertext that applyHint returns is
+//    a sum of (hint columns) products of an encrypted secret value with a
+//    plaintext of limbs. This fails if a plaintext coefficient of the sum
+//    wraps around the BFV plaintext modulus (which never happens if the
+//    largest possible sum fits), or if the BFV noise grows past q/(2t).
+// 2) Decoding the SimplePIR answer. Each answer entry holds Delta x d plus
+//    the error D x e (for the query error e) plus the error from dropping
+//    the low-order limbs of the hint; rounding fails if this exceeds
+//    Delta/2.
+//
+// The noise terms are sums of many independent errors, which we model as
+// Gaussians. The BFV noise and D x e take their worst-case variance (all
+// limb and database values at their maximum). The error from the dropped
+// limbs is a sum of (secret value) x (low-order bits of a hint entry),
+// which is always non-negative; since the hint is D x A for a uniform A,
+// we take its low-order bits to be uniform. The failure probabilities are
+// Gaussian tail bounds, combined with union bounds, and reported as log2
+// of the probability.
+
+// BFV parameters in rlwe/rlwe.cpp.
+const bfvRingDegree = 2048
+const bfvPlainModulus = 65537
+const bfvCoeffModulusBits = 38
+const bfvSigma = 3.19 // SEAL's default noise standard deviation
+
+type FailureParams struct {
+  ElemBits  uint64 // 32 or 64
+  Limbs     uint64 // number of top-order limbs that the server computes over
+  LimbBits  uint64
+  SecretMax uint64
+}
+
+// The parameters that this package uses for elements of type T.
+func DefaultFailureParams[T matrix.Elem]() FailureParams {
+  return FailureParams{
+    ElemBits: T(0).Bitlen(),
+    Limbs: uint64(numLimbs[T]()),
+    LimbBits: BitsPerLimb,
+    SecretMax: SecretMax,
+  }
+}
+
+type FailureReport struct {
+  // Token decryption
+  MaxLimbSum        uint64  // largest plaintext coefficient in applyHint (must be < bfvPlainModulus)
+  TokenNoiseStd     float64 // BFV noise after applyHint
+  TokenNoiseBound   float64 // BFV noise above which decryption fails
+  TokenFailureLog2  float64 // per token
+
+  // SimplePIR decoding
+  DroppedError      float64 // mean error from the dropped limbs
+  DroppedErrorStd   float64
+  DecodeNoiseStd    float64 // error D x e
+  EntryFailureLog2  float64 // per answer entry
+  DecodeFailureLog2 float64 // per query (over all answer entries)
+
+  FailureLog2       float64 // per query, overall
+}
+
+// Error from the SimplePIR query in one answer entry (D x e), with all
+// database values at p-1.
+func decodeNoiseStd(sigma float64, p, m uint64) float64 {
+  return sigma * float64(p - 1) * math.Sqrt(float64(m))
+}
+
+// Largest error from dropping all but the top 'limbs' limbs of the hint.
+func droppedError(fp FailureParams, hintCols uint64) float64 {
+  dropped := fp.ElemBits - fp.Limbs * fp.LimbBits
+  return float64(hintCols) * float64(fp.SecretMax) * (math.Exp2(float64(dropped)) - 1)
+}
+
+// Mean and standard deviation of the error from dropping all but the top
+// 'limbs' limbs of the hint, for secret values uniform in [0, SecretMax]
+// and uniform hint entries.
+func droppedErrorDist(fp FailureParams, hintCols uint64) (float64, float64) {
+  low := math.Exp2(float64(fp.ElemBits - fp.Limbs * fp.LimbBits)) - 1
+  lowMean, lowSq := low/2, low*(2*low + 1)/6
+  smax := float64(fp.SecretMax)
+  sMean, sSq := smax/2, smax*(2*smax + 1)/6
+
+  mean := float64(hintCols) * sMean * lowMean
+  variance := float64(hintCols) * (sSq*lowSq - sMean*sMean*lowMean*lowMean)
+  return mean, math.Sqrt(variance)
+}
+
+// log2 of Pr[X > bound], for X ~ N(0, std^2).
+func upperTailLog2(bound, std float64) float64 {
+  if bound <= 0 {
+    return 0
+  }
+  z := bound / (std * math.Sqrt2)
+  if p := math.Erfc(z) / 2; p > 1e-300 {
+    return math.Log2(p)
+  }
+  // Asymptotic expansion, once erfc() underflows
+  return (-z*z - math.Log(2 * z * math.Sqrt(math.Pi))) / math.Ln2
+}
+
+// log2 of a union bound over 'count' events, each with probability 2^p.
+func unionLog2(p float64, count uint64) float64 {
+  return math.Min(0, p + math.Log2(float64(count)))
+}
+
+// log2(2^a + 2^b)
+func addLog2(a, b float64) float64 {
+  hi, lo := math.Max(a, b), math.Min(a, b)
+  return math.Min(0, hi + math.Log2(1 + math.Exp2(lo - hi)))
+}
+
+// Bound the failure probability of a query to the database 'info', with
+// the parameters used for elements of type T.
+func AnalyzeFailure[T matrix.Elem](info *pir.DBInfo) *FailureReport {
+  return AnalyzeFailureParams(info, DefaultFailureParams[T]())
+}
+
+func AnalyzeFailureParams(info *pir.DBInfo, fp FailureParams) *FailureReport {
+  if fp.Limbs * fp.LimbBits > fp.ElemBits {
+    panic("Too many limbs")
+  }
+
+  r := new(FailureReport)
+  cols := info.Params.N
+  maxLimb := uint64(1 << fp.LimbBits) - 1
+
+  // 1) Token decryption. Each encrypted secret value is a constant
+  // polynomial, so each coefficient of the result is a sum of 'cols'
+  // products of a secret value with a limb.
+  r.MaxLimbSum = cols * fp.SecretMax * maxLimb
+
+  // The fresh noise of each encrypted secret value is multiplied by a
+  // plaintext with up to N coefficients, then 'cols' products are added.
+  r.TokenNoiseStd = bfvSigma * float64(maxLimb) * math.Sqrt(float64(cols * bfvRingDegree))
+
+  // Decryption is correct while the noise is below q/(2t), less the
+  // rounding error of the scaled plaintext (at most MaxLimbSum).
+  q := math.Exp2(bfvCoeffModulusBits - 1)
+  r.TokenNoiseBound = q / (2 * bfvPlainModulus) - float64(r.MaxLimbSum)
+
+  if r.MaxLimbSum >= bfvPlainModulus {
+    r.TokenFailureLog2 = 0
+  } else {
+    cts := fp.Limbs * ((info.L + bfvRingDegree - 1) / bfvRingDegree)
+    tail := upperTailLog2(r.TokenNoiseBound, r.TokenNoiseStd) + 1
+    r.TokenFailureLog2 = unionLog2(tail, cts * bfvRingDegree)
+  }
+
+  // 2) SimplePIR decoding: the total error is D x e plus the dropped
+  // limbs, and rounding fails if it leaves [-Delta/2, Delta/2).
+  r.DroppedError, r.DroppedErrorStd = droppedErrorDist(fp, cols)
+  r.DecodeNoiseStd = decodeNoiseStd(info.Params.Sigma, info.Params.P, info.M)
+  std := math.Hypot(r.DecodeNoiseStd, r.DroppedErrorStd)
+  half := float64(info.Params.Delta)/2
+  r.EntryFailureLog2 = addLog2(upperTailLog2(half - 1 - r.DroppedError, std),
+                               upperTailLog2(half + r.DroppedError, std))
+  r.DecodeFailureLog2 = unionLog2(r.EntryFailureLog2, info.L)
+
+  r.FailureLog2 = addLog2(r.TokenFailureLog2, r.DecodeFailureLog2)
+  return r
+}
@@ -0,0 +1,216 @@
+package underhood
+
+import (
+  "math"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+func TestFailureDefaults(t *testing.T) {
+  params64 := lwe.NewParamsFixedP(64, 1<<10, 512)
+  params32 := lwe.NewParamsFixedP(32, 1<<10, 512)
+  info64 := pir.NewDBInfoFixedParams(1<<20, 9, params64, true)
+  info32 := pir.NewDBInfoFixedParams(1<<20, 9, params32, true)
+
+  for _, r := range []*FailureReport{ AnalyzeFailure[matrix.Elem64](info64),
+                                      AnalyzeFailure[matrix.Elem32](info32) } {
+    if r.MaxLimbSum >= bfvPlainModulus {
+      t.Errorf("Limb sum %v overflows", r.MaxLimbSum)
+    }
+    if r.FailureLog2 > -40 {
+      t.Errorf("Failure probability 2^%.1f is too high: %+v", r.FailureLog2, r)
+    }
+  }
+
+  // Wider limbs overflow the BFV plaintext modulus
+  fp := DefaultFailureParams[matrix.Elem64]()
+  fp.LimbBits = 5
+  fp.Limbs = 6
+  if r := AnalyzeFailureParams(info64, fp); r.FailureLog2 != 0 {
+    t.Errorf("Expected certain failure, got 2^%.1f", r.FailureLog2)
+  }
+
+  // Dropping more limbs only makes failure more likely
+  fp = DefaultFailureParams[matrix.Elem64]()
+  base := AnalyzeFailureParams(info64, fp)
+  fp.Limbs -= 1
+  if r := AnalyzeFailureParams(info64, fp); r.DecodeFailureLog2 <= base.DecodeFailureLog2 {
+    t.Error("Dropping a limb did not increase the failure probability")
+  }
+}
+
+// Run SimplePIR with a shrunken Delta, so that decoding fails often enough
+// to measure, and compare the failure rate with the analysis.
+func TestFailureEmpirical(t *testing.T) {
+  params := *lwe.NewParamsFixedP(64, 1<<10, 512)
+  num := uint64(1<<10)
+
+  // Worst-case database: every value is p-1
+  vals := make([]uint64, num)
+  for i := range vals {
+    vals[i] = params.P - 1
+  }
+  info := pir.NewDBInfoFixedParams(num, 9, &params, true)
+
+  // Place the rounding threshold (Delta/2) two standard deviations out
+  std := decodeNoiseStd(params.Sigma, params.P, info.M)
+  params.Delta = uint64(4 * std)
+
+  db := pir.NewDatabaseFixedParams[matrix.Elem64](num, 9, vals, &params)
+  server := pir.NewServer(db)
+
+  // No limbs dropped: this is plain SimplePIR
+  fp := DefaultFailureParams[matrix.Elem64]()
+  fp.Limbs = 64 / fp.LimbBits
+  r := AnalyzeFailureParams(db.Info, fp)
+  if r.DroppedError != 0 || math.Abs(r.DecodeNoiseStd - std) > 1e-9 * std {
+    t.Fatal("Unexpected analysis")
+  }
+  predicted := math.Exp2(r.EntryFailureLog2)
+
+  // A query is A x s + e + Delta x u_i, and the A x s term cancels exactly
+  // against the hint, so we send e + Delta x u_i. The answer entries of
+  // one query share e, so we count one entry per query.
+  const queries = 20000
+  prg := rand.NewRandomBufPRG()
+  failures := 0
+  for i := uint64(0); i < queries; i++ {
+    q := matrix.Gaussian[matrix.Elem64](prg, db.Info.M, 1)
+    q.AddAt(i % db.Info.M, 0, matrix.Elem64(params.Delta))
+    if db.Info.M % db.Info.Squishing != 0 {
+      q.AppendZeros(db.Info.Squishing - (db.Info.M % db.Info.Squishing))
+    }
+
+    ans := server.Answer(&pir.Query[matrix.Elem64]{ Query: q })
+    if params.Round(uint64(ans.Answer.Get(0, 0))) != params.P - 1 {
+      failures += 1
+    }
+  }
+
+  // The count of failures is binomial: allow 5 standard deviations (a
+  // false alarm about once in 10^6 runs)
+  rate := float64(failures) / queries
+  slack := 5 * math.Sqrt(predicted * (1 - predicted) / queries)
+  t.Logf("Failure rate %.4f, predicted %.4f (+/- %.4f)", rate, predicted, slack)
+  if math.Abs(rate - predicted) > slack {
+    t.Errorf("Failure rate %.4f does not match prediction %.4f", rate, predicted)
+  }
+}
+
+// Compare the distribution of the error from the dropped limbs with that
+// of a random hint and random secrets.
+func TestDroppedErrorEmpirical(t *testing.T) {
+  fp := DefaultFailureParams[matrix.Elem32]()
+  cols := uint64(1408)
+  mean, std := droppedErrorDist(fp, cols)
+
+  // Each sample uses a fresh hint row and a fresh secret
+  const samples = 4000
+  prg := rand.NewRandomBufPRG()
+  hint := matrix.Rand[matrix.Elem32](prg, samples, cols, 0)
+  secrets := matrix.Ternary[matrix.Elem32](prg, cols, samples)
+  mask := uint64(1 << (32 - fp.Limbs*fp.LimbBits)) - 1
+
+  var sum, sumSq float64
+  for i := uint64(0); i < samples; i++ {
+    e := uint64(0)
+    for j := uint64(0); j < cols; j++ {
+      e += (uint64(hint.Get(i, j)) & mask) * uint64(secrets.Get(j, i))
+    }
+    sum += float64(e)
+    sumSq += float64(e) * float64(e)
+  }
+
+  n := float64(samples)
+  gotMean := sum / n
+  gotStd := math.Sqrt(sumSq/n - gotMean*gotMean)
+  t.Logf("Mean %.0f (predicted %.0f), std %.0f (predicted %.0f)", gotMean, mean, gotStd, std)
+  if math.Abs(gotMean - mean) > 0.02 * mean || math.Abs(gotStd - std) > 0.1 * std {
+    t.Error("Dropped-limb error does not match prediction")
+  }
+  if gotMean + 10*gotStd > droppedError(fp, cols) {
+    t.Error("Worst-case bound is too small")
+  }
+}
+
+// An inner scheme whose secrets are all SecretMax (the worst case for the
+// token noise).
+type maxSecretInner[T matrix.Elem] struct {
+  toyInner[T]
+}
+
+func (s *maxSecretInner[T]) GenerateSecret() *matrix.Matrix[T] {
+  out := matrix.Zeros[T](s.hint.Cols(), 1)
+  out.AddConst(SecretMax)
+  return out
+}
+
+// Measure the noise of the token ciphertexts after applyHint, for a
+// worst-case hint (every limb at its largest), and compare it with the
+// analysis.
+func TestTokenNoiseEmpirical(t *testing.T) {
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  info := pir.NewDBInfoFixedParams(1<<21, 9, params, true)
+  r := AnalyzeFailure[matrix.Elem64](info)
+
+  hint := matrix.Zeros[matrix.Elem64](info.L, params.N)
+  hint.SubConst(1)
+  inner := &maxSecretInner[matrix.Elem64]{ toyInner[matrix.Elem64]{ hint: hint } }
+
+  server := NewTokenServer[matrix.Elem64](inner)
+  defer server.Free()
+  client := NewTokenClient[matrix.Elem64](inner)
+  defer client.Free()
+
+  ans, err := server.HintAnswer(client.HintQuery(1))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  key := client.params.ctx.NewKeyFromSeed(client.outerSeed)
+  defer key.Free()
+  ct := rlwe.NewCiphertext()
+  defer ct.Free()
+
+  budget := bfvCoeffModulusBits
+  coeffs := 0
+  for _, lst := range ans.HintCts {
+    for _, blob := range lst {
+      if err := ct.Load(client.params.ctx, blob); err != nil {
+        t.Fatal(err)
+      }
+      if b := key.NoiseBudget(ct); b < budget {
+        budget = b
+      }
+      coeffs += int(client.params.ctx.N())
+    }
+  }
+  if budget <= 0 {
+    t.Fatal("Token does not decrypt")
+  }
+
+  // The largest noise is below q/(t x 2^(budget+1)), and at least half of
+  // that (and q is between 2^37 and 2^38)
+  hi := math.Exp2(float64(bfvCoeffModulusBits - budget - 1)) / bfvPlainModulus
+  lo := hi / 4
+
+  // Each coefficient has standard deviation TokenNoiseStd, so the largest
+  // is at least that (with overwhelming probability), and at most the
+  // largest of 'coeffs' independent samples, about sqrt(2 ln(2 coeffs))
+  // standard deviations. (With a constant hint, neighboring coefficients
+  // share most of their terms, so the largest is well below that.)
+  predicted := r.TokenNoiseStd * math.Sqrt(2 * math.Log(2 * float64(coeffs)))
+  t.Logf("Budget %d bits: noise in [%.0f, %.0f), std %.0f, independent max %.0f, bound %.0f",
+         budget, lo, hi, r.TokenNoiseStd, predicted, r.TokenNoiseBound)
+
+  if hi < r.TokenNoiseStd || lo > predicted {
+    t.Errorf("Measured noise does not match TokenNoiseStd")
+  }
+  if lo >= r.TokenNoiseBound {
+    t.Errorf("Measured noise is above TokenNoiseBound")
+  }
+}
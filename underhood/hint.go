@@ -1,6 +1,7 @@
 package underhood
 
 import (
+  "fmt"
   "log"
   "github.com/henrycg/simplepir/matrix"
   "github.com/ahenzinger/underhood/rlwe"
@@ -75,24 +76,27 @@ func makePlaintext[T matrix.Elem](p *params, hint *matrix.Matrix[T], index int)
   return out
 }
 
-func decomposeHint[T matrix.Elem](p *params, hint *matrix.Matrix[T]) *hintDecomp {
-  d := new(hintDecomp)
-  n := p.ctx.N()
-  d.rows = (hint.Rows() + n - 1)/n    // Compute Hint.Rows()/n rounded up
-  d.cols = hint.Cols()
-  d.hintRows = hint.Rows()
-
-  maxLimbs := int(T(0).Bitlen()/BitsPerLimb)
-  limbs := 0
+// Number of (top-order) limbs of each SimplePIR hint element that the server
+// computes over. Other inner schemes set their own (see InnerParams).
+func numLimbs[T matrix.Elem]() int {
   switch T(0).Bitlen() {
   case 32:
-    limbs = NumLimbs32
+    return NumLimbs32
   case 64:
-    limbs = NumLimbs64
+    return NumLimbs64
   default:
     panic("Should not reach")
   }
+}
+
+func decomposeHint[T matrix.Elem](p *params, hint *matrix.Matrix[T], limbs int) *hintDecomp {
+  d := new(hintDecomp)
+  n := p.ctx.N()
+  d.rows = (hint.Rows() + n - 1)/n    // Compute Hint.Rows()/n rounded up
+  d.cols = hint.Cols()
+  d.hintRows = hint.Rows()
 
+  maxLimbs := int(T(0).Bitlen()/BitsPerLimb)
   d.pts = make([][]*rlwe.Plaintext, limbs)
   for b := 0; b < limbs; b++ {
     d.pts[b] = makePlaintext(p, hint, maxLimbs - b - 1)
@@ -109,24 +113,52 @@ func (h *hintDecomp) Free() {
   }
 }
 
-func (p *params) applyHint(hint *hintDecomp, encSkIn []CipherBlob) [][]CipherBlob {
+// The encrypted secret may hold several secret vectors, one after the
+// other. The output holds the limbs for the first secret vector, then
+// the limbs for the second, and so on.
+//
+// Returns an error if any of the encrypted secret values is malformed.
+func (p *params) applyHint(hint *hintDecomp, encSkIn []CipherBlob) ([][]CipherBlob, error) {
+  cols := int(hint.cols)
+  if cols == 0 || len(encSkIn) == 0 || len(encSkIn) % cols != 0 {
+    log.Printf("%d is not a multiple of %d\n", len(encSkIn), hint.cols)
+    panic("Wrong number of encrypted SK values")
+  }
+
+  limbs := len(hint.pts)
+  secrets := len(encSkIn) / cols
+  out := make([][]CipherBlob, secrets*limbs)
+
+  for j := 0; j < secrets; j++ {
+    err := p.applyHintSecret(hint, encSkIn[j*cols:(j+1)*cols], out[j*limbs:(j+1)*limbs])
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  return out, nil
+}
+
+func (p *params) applyHintSecret(hint *hintDecomp, encSkIn []CipherBlob, out [][]CipherBlob) error {
   encSk := make([]*rlwe.Ciphertext, len(encSkIn))
 
   for i, v := range encSkIn {
     encSk[i] = rlwe.NewCiphertext()
     defer encSk[i].Free()
 
-    encSk[i].Load(p.ctx, v)
-  }
+    if err := encSk[i].Load(p.ctx, v); err != nil {
+      return fmt.Errorf("%w: encrypted secret value %d: %v", ErrBadHintQuery, i, err)
+    }
 
-  limbs := len(hint.pts)
-  out := make([][]CipherBlob, limbs)
+    // Transform once, rather than once per row and limb: the inner products
+    // then run entirely in the NTT domain
+    encSk[i].ToNTT(p.ctx)
+  }
 
-  for b := 0; b < limbs; b++ {
+  for b := range out {
     out[b] = p.applyHintOnce(hint, encSk, b)
   }
-
-  return out
+  return nil
 }
 
 func (p *params) applyHintOnce(hint *hintDecomp, encSk []*rlwe.Ciphertext, chunk int) []CipherBlob {
@@ -155,6 +187,9 @@ func (p *params) applyHintOnce(hint *hintDecomp, encSk []*rlwe.Ciphertext, chunk
         ct := rlwe.NewCiphertext()
         defer ct.Free()
         ct.SetInnerProduct(p.ctx, encSk, hint.pts[chunk][i*cols:(i+1)*cols])
+        if ct.IsNTT() {
+          ct.FromNTT(p.ctx)
+        }
         out[i] = ct.Store()
       }
       ch <- 0
@@ -169,30 +204,71 @@ func (p *params) applyHintOnce(hint *hintDecomp, encSk []*rlwe.Ciphertext, chunk
   return out
 }
 
-func (c *Client[T]) recoverAS(ans *HintAnswer) *matrix.Matrix[T] {
-  sk := c.params.ctx.NewKey()
-  defer sk.Free()
+// Recover H.s, with one column per secret vector.
+func (c *TokenClient[T]) recoverAS(ans *HintAnswer) (*matrix.Matrix[T], error) {
+  if err := c.checkHintAnswer(ans); err != nil {
+    return nil, err
+  }
 
-  sk.Load(c.params.ctx, c.outerSecret)
+  sk := c.params.ctx.NewKeyFromSeed(c.outerSeed)
+  defer sk.Free()
 
-  out := matrix.Zeros[T](ans.MatrixRows, 1)
+  limbs := c.inner.HintLimbs()
+  secrets := uint64(len(ans.HintCts) / limbs)
+  out := matrix.Zeros[T](ans.MatrixRows, secrets)
   maxLimbs := int(T(0).Bitlen()/BitsPerLimb)
 
-  for b := 0; b < len(ans.HintCts); b++ {
-    part := c.recoverASonce(sk, ans, b)
-    part.MulConst(1 << (BitsPerLimb*(maxLimbs-b-1)))
-    out.Add(part) 
+  for j := uint64(0); j < secrets; j++ {
+    col := matrix.Zeros[T](ans.MatrixRows, 1)
+    for b := 0; b < limbs; b++ {
+      part, err := c.recoverASonce(sk, ans.MatrixRows, ans.HintCts[int(j)*limbs + b])
+      if err != nil {
+        return nil, err
+      }
+      part.MulConst(1 << (BitsPerLimb*(maxLimbs-b-1)))
+      col.Add(part) 
+    }
+    setColumn(out, j, col)
   }
 
-  return out
+  return out, nil
+}
+
+// Check that the hint answer has the shape that this client's token expects.
+func (c *TokenClient[T]) checkHintAnswer(ans *HintAnswer) error {
+  if ans == nil {
+    return fmt.Errorf("%w: missing", ErrBadHintAnswer)
+  }
+
+  if c.innerSecret == nil {
+    panic("Must call HintQuery first")
+  }
+
+  if ans.MatrixRows != c.inner.HintRows() {
+    return fmt.Errorf("%w: got %d rows, want %d", ErrBadHintAnswer, ans.MatrixRows, c.inner.HintRows())
+  }
+
+  limbs := c.inner.HintLimbs() * int(c.innerSecret.Cols())
+  if len(ans.HintCts) != limbs {
+    return fmt.Errorf("%w: got %d limbs, want %d", ErrBadHintAnswer, len(ans.HintCts), limbs)
+  }
+
+  n := c.params.ctx.N()
+  cts := int((ans.MatrixRows + n - 1)/n)
+  for _, lst := range ans.HintCts {
+    if len(lst) != cts {
+      return fmt.Errorf("%w: got %d ciphertexts per limb, want %d", ErrBadHintAnswer, len(lst), cts)
+    }
+  }
+
+  return nil
 }
 
-func (client *Client[T]) recoverASonce(sk *rlwe.Key, ans *HintAnswer, chunk int) *matrix.Matrix[T] {
-  out := matrix.New[T](ans.MatrixRows, 1)
+func (client *TokenClient[T]) recoverASonce(sk *rlwe.Key, rows uint64, cts []CipherBlob) (*matrix.Matrix[T], error) {
+  out := matrix.New[T](rows, 1)
   n := client.params.ctx.N()
 
   vals := make([]uint64, n)
-  cts := ans.HintCts[chunk]
 
   c := rlwe.NewCiphertext()
   defer c.Free()
@@ -201,15 +277,19 @@ func (client *Client[T]) recoverASonce(sk *rlwe.Key, ans *HintAnswer, chunk int)
   defer pt.Free()
 
   for i := 0; i < len(cts); i++ {
-    c.Load(client.params.ctx, cts[i])
-    sk.Decrypt(c, pt)
+    if err := c.Load(client.params.ctx, cts[i]); err != nil {
+      return nil, fmt.Errorf("%w: ciphertext %d: %v", ErrBadHintAnswer, i, err)
+    }
+    if err := sk.Decrypt(c, pt); err != nil {
+      return nil, fmt.Errorf("%w: ciphertext %d: %v", ErrBadHintAnswer, i, err)
+    }
 
     pt.Dump(vals)
-    for j := uint64(0); (j < n) && (uint64(i)*n + j < ans.MatrixRows); j++ {
+    for j := uint64(0); (j < n) && (uint64(i)*n + j < rows); j++ {
       raw := fromModuloP[T](client.params.ctx.P(), uint64(vals[j]))
       out.Set(uint64(i)*n + j, 0, raw)
     }
   }
   
-  return out
+  return out, nil
 }
@@ -0,0 +1,266 @@
+package underhood
+
+import (
+  "io"
+  "fmt"
+  "crypto/sha256"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+// The token machinery (decomposeHint, applyHint, recoverAS) does not depend
+// on SimplePIR itself. It works for any "inner" LWE-based linearly
+// homomorphic scheme in which:
+// 1) the server holds a hint matrix H (e.g., H = D x A, for the database D
+//    and the public matrix A), and
+// 2) the client needs only H x s, for its secret s with entries in the
+//    scheme's SecretBounds, and only in the top HintLimbs limbs of each
+//    entry, to decrypt answers.
+//
+// TokenServer and TokenClient run the token protocol for any scheme that
+// implements InnerServer and InnerClient. Server and Client use them with
+// SimplePIR, and DoublePIRServer and DoublePIRClient (doublepir.go) with
+// DoublePIR.
+
+// The parameters of the inner scheme that the token protocol depends on.
+// The server and the client must agree on them.
+type InnerParams interface {
+  // Number of top-order limbs (of BitsPerLimb bits) of each hint entry that
+  // the token computes over. Each entry of the recovered H x s is then too
+  // small by up to (hint columns) x (secret max) x 2^(dropped bits), which
+  // decryption must tolerate.
+  HintLimbs() int
+
+  // Bounds (min, max) on the entries of the secret. The secret is encrypted
+  // as is, so entries can't be negative.
+  SecretBounds() (uint64, uint64)
+}
+
+type InnerServer[T matrix.Elem] interface {
+  InnerParams
+  Hint() *matrix.Matrix[T]
+}
+
+type InnerClient[T matrix.Elem] interface {
+  InnerParams
+
+  // Sample a fresh secret, as a column vector.
+  GenerateSecret() *matrix.Matrix[T]
+
+  // Number of rows in the server's hint matrix.
+  HintRows() uint64
+}
+
+// SimplePIR's parameters: see NumLimbs64 and NumLimbs32, and SecretMax.
+type simplePIRParams[T matrix.Elem] struct{}
+
+func (simplePIRParams[T]) HintLimbs() int {
+  return numLimbs[T]()
+}
+
+func (simplePIRParams[T]) SecretBounds() (uint64, uint64) {
+  return SecretMin, SecretMax
+}
+
+// *pir.Server and *pir.Client need adapters.
+type simplePIRServer[T matrix.Elem] struct {
+  *pir.Server[T]
+  simplePIRParams[T]
+}
+
+type simplePIRClient[T matrix.Elem] struct {
+  *pir.Client[T]
+  simplePIRParams[T]
+  prg *rand.BufPRGReader // if set, the source of the secrets (for tests)
+}
+
+// Sample a ternary secret, as pir.Client does.
+func (c simplePIRClient[T]) GenerateSecret() *matrix.Matrix[T] {
+  if c.prg == nil {
+    return c.Client.GenerateSecret()
+  }
+  return matrix.Ternary[T](c.prg, c.GetSecurityParam(), 1)
+}
+
+func (c simplePIRClient[T]) HintRows() uint64 {
+  return c.GetL()
+}
+
+// An InnerServer that holds only a (SimplePIR) hint.
+type hintOnly[T matrix.Elem] struct {
+  hint *matrix.Matrix[T]
+  simplePIRParams[T]
+}
+
+func (h hintOnly[T]) Hint() *matrix.Matrix[T] {
+  return h.hint
+}
+
+type TokenServer[T matrix.Elem] struct {
+  params     *params
+  ownsParams bool // false if the RLWE context is shared (see Registry)
+  hint       *hintDecomp
+}
+
+// Beware! You must call Free() on the output TokenServer to clean up C++ objects.
+func NewTokenServer[T matrix.Elem](inner InnerServer[T]) *TokenServer[T] {
+  s := newTokenServer[T](newParams(), inner)
+  s.ownsParams = true
+  return s
+}
+
+// Panics if the inner scheme's parameters don't fit the RLWE parameters.
+func newTokenServer[T matrix.Elem](params *params, inner InnerServer[T]) *TokenServer[T] {
+  hint := inner.Hint()
+  limbs := inner.HintLimbs()
+  if limbs < 1 || limbs > int(T(0).Bitlen()/BitsPerLimb) {
+    panic("Bad number of hint limbs")
+  }
+
+  // Each plaintext coefficient in applyHint is a sum of (hint columns)
+  // products of a limb with a secret entry
+  _, smax := inner.SecretBounds()
+  if hint.Cols() * smax * ((1 << BitsPerLimb) - 1) >= params.ctx.P() {
+    panic("Limb sums may wrap around mod the RLWE plaintext modulus")
+  }
+
+  return &TokenServer[T]{
+    params: params,
+    hint: decomposeHint(params, hint, limbs),
+  }
+}
+
+func (s *TokenServer[T]) Free() {
+  s.hint.Free()
+  if s.ownsParams {
+    s.params.Free()
+  }
+}
+
+func (s *TokenServer[T]) checkHintQuery(q *HintQuery) error {
+  if q == nil {
+    return fmt.Errorf("%w: missing", ErrBadHintQuery)
+  }
+
+  cols := s.hint.cols
+  num := uint64(len(*q))
+  if num == 0 || num % cols != 0 {
+    return fmt.Errorf("%w: got %d encrypted secret values, want a multiple of %d",
+                      ErrBadHintQuery, num, cols)
+  }
+
+  if num / cols > MaxSecretsPerQuery {
+    return fmt.Errorf("%w: too many secrets (%d)", ErrBadHintQuery, num / cols)
+  }
+
+  return nil
+}
+
+func (s *TokenServer[T]) HintAnswer(q *HintQuery) (*HintAnswer, error) {
+  if err := s.checkHintQuery(q); err != nil {
+    return nil, err
+  }
+
+  cts, err := s.params.applyHint(s.hint, *q)
+  if err != nil {
+    return nil, err
+  }
+
+  return &HintAnswer{
+    HintCts: cts,
+    MatrixRows: s.hint.hintRows,
+  }, nil
+}
+
+type TokenClient[T matrix.Elem] struct {
+  params      *params
+  inner       InnerClient[T]
+
+  innerSecret *matrix.Matrix[T]
+  outerSeed   *rlwe.Seed // the RLWE key derives from this seed
+  fixedKey    bool       // keep outerSeed across tokens (public-key mode)
+
+  keySeeds    io.Reader // source of outer seeds (nil for crypto/rand)
+}
+
+// WARNING: You must call Free() on this client to cleanup
+func NewTokenClient[T matrix.Elem](inner InnerClient[T]) *TokenClient[T] {
+  return &TokenClient[T]{
+    params: newParams(),
+    inner: inner,
+  }
+}
+
+// A TokenClient whose randomness derives from 'seed' (for tests only).
+func newTokenClientSeeded[T matrix.Elem](inner InnerClient[T], seed *rlwe.Seed) *TokenClient[T] {
+  return &TokenClient[T]{
+    params: newParamsSeeded(seed),
+    inner: inner,
+    keySeeds: rand.NewBufPRG(rand.NewPRG(derivePRGKey(seed, "outer key seeds"))),
+  }
+}
+
+// Derive a PRG key from 'seed', separately for each 'purpose'.
+func derivePRGKey(seed *rlwe.Seed, purpose string) *rand.PRGKey {
+  sum := sha256.Sum256(append([]byte("underhood: " + purpose), seed[:]...))
+  var key rand.PRGKey
+  copy(key[:], sum[:])
+  return &key
+}
+
+// A fresh seed for the RLWE key.
+func (c *TokenClient[T]) newKeySeed() *rlwe.Seed {
+  if c.keySeeds == nil {
+    return rlwe.NewSeed()
+  }
+  seed := new(rlwe.Seed)
+  if _, err := io.ReadFull(c.keySeeds, seed[:]); err != nil {
+    panic(err)
+  }
+  return seed
+}
+
+func (c *TokenClient[T]) Free() {
+  c.params.Free()
+}
+
+// Generate a token request for k secrets (one per message column).
+func (c *TokenClient[T]) HintQuery(k uint64) *HintQuery {
+  var q *HintQuery
+  c.innerSecret, c.outerSeed, q = c.newHintQuery(k)
+  return q
+}
+
+// Sample k fresh secrets, and encrypt them under a fresh RLWE key (or the
+// fixed one, in public-key mode). This leaves the client's current token
+// as is.
+func (c *TokenClient[T]) newHintQuery(k uint64) (*matrix.Matrix[T], *rlwe.Seed, *HintQuery) {
+  if k == 0 {
+    panic("Need at least one secret")
+  }
+
+  var secret *matrix.Matrix[T]
+  for j := uint64(0); j < k; j++ {
+    s := c.inner.GenerateSecret()
+    if secret == nil {
+      secret = matrix.Zeros[T](s.Rows(), k)
+    }
+    setColumn(secret, j, s)
+  }
+
+  seed, encSk := c.encryptSecret(secret)
+  return secret, seed, &encSk
+}
+
+// The inner secrets, with one column per secret.
+func (c *TokenClient[T]) Secret() *matrix.Matrix[T] {
+  return c.innerSecret
+}
+
+// Recover H x s, with one column per secret. Returns an error (wrapping
+// ErrBadHintAnswer) if the server's answer is malformed.
+func (c *TokenClient[T]) HintRecover(ans *HintAnswer) (*matrix.Matrix[T], error) {
+  return c.recoverAS(ans)
+}
@@ -0,0 +1,71 @@
+package underhood
+
+import (
+  "testing"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// A toy inner scheme, whose hint is a random matrix, with SimplePIR's
+// parameters.
+type toyInner[T matrix.Elem] struct {
+  hint *matrix.Matrix[T]
+  simplePIRParams[T]
+}
+
+func (s *toyInner[T]) Hint() *matrix.Matrix[T] {
+  return s.hint
+}
+
+func (s *toyInner[T]) GenerateSecret() *matrix.Matrix[T] {
+  return matrix.Ternary[T](rand.NewRandomBufPRG(), s.hint.Cols(), 1)
+}
+
+func (s *toyInner[T]) HintRows() uint64 {
+  return s.hint.Rows()
+}
+
+func testTokenInner[T matrix.Elem](t *testing.T, rows, cols uint64) {
+  inner := &toyInner[T]{ hint: matrix.Rand[T](rand.NewRandomBufPRG(), rows, cols, 0) }
+
+  server := NewTokenServer[T](inner)
+  defer server.Free()
+
+  client := NewTokenClient[T](inner)
+  defer client.Free()
+
+  for _, k := range []uint64{1, 3} {
+    ans, err := server.HintAnswer(client.HintQuery(k))
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    hs, err := client.HintRecover(ans)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    // The token drops the low-order limbs of the hint, so the result is
+    // only correct up to a (non-negative) error in the low-order bits.
+    dropped := T(0).Bitlen() - uint64(numLimbs[T]()*BitsPerLimb)
+    bound := cols * SecretMax << dropped
+
+    expected := matrix.Mul(inner.hint, client.Secret())
+    expected.Sub(hs)
+    for i := uint64(0); i < rows; i++ {
+      for j := uint64(0); j < k; j++ {
+        if uint64(expected.Get(i, j)) > bound {
+          t.Fatalf("Token is wrong at (%v, %v): off by %v", i, j, expected.Get(i, j))
+        }
+      }
+    }
+  }
+}
+
+func TestTokenInner64(t *testing.T) {
+  testTokenInner[matrix.Elem64](t, 3000, 1024)
+}
+
+func TestTokenInner32(t *testing.T) {
+  testTokenInner[matrix.Elem32](t, 3000, 1024)
+}
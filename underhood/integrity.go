@@ -0,0 +1,170 @@
+package underhood
+
+import (
+  "errors"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/binary"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// Optional integrity checks for PIR answers.
+//
+// The data owner, who holds an IntegrityKey, appends 'tag' rows to the
+// database: the tag of column j is a MAC (HMAC-SHA256) of j and of the
+// column's contents, split into Z_p elements. The server stores the tagged
+// database as usual, but never learns the key. A client that holds the key
+// recovers the whole column (data and tag) and recomputes the tag. A
+// malformed token or answer decodes to a column that fails this check,
+// except with probability about 2^-TagBits.
+//
+// Because the tag binds the column index, a server also cannot substitute
+// another column of the database. However, a malicious server can still
+// corrupt answers selectively and observe whether the client aborts, so
+// a client should not reveal (or retry after) a failed check.
+
+var ErrIntegrity = errors.New("underhood: answer failed integrity check")
+
+// Minimum number of tag bits per database column.
+const TagBits = 128
+
+type IntegrityKey [32]byte
+
+func NewIntegrityKey() *IntegrityKey {
+  var key IntegrityKey
+  if _, err := rand.Read(key[:]); err != nil {
+    panic(err)
+  }
+  return &key
+}
+
+// Number of bits of tag stored in each Z_p element.
+func tagBitsPerElem(p uint64) uint64 {
+  bits := uint64(0)
+  for (uint64(1) << (bits+1)) <= p {
+    bits += 1
+  }
+  return bits
+}
+
+func tagRows(p uint64) uint64 {
+  bits := tagBitsPerElem(p)
+  return (TagBits + bits - 1) / bits
+}
+
+// Compute the tag of column 'col', with contents 'vals'.
+func (key *IntegrityKey) tag(p, col uint64, vals []uint64) []uint64 {
+  mac := hmac.New(sha256.New, key[:])
+  var buf [8]byte
+  binary.LittleEndian.PutUint64(buf[:], col)
+  mac.Write(buf[:])
+  for _, v := range vals {
+    binary.LittleEndian.PutUint64(buf[:], v)
+    mac.Write(buf[:])
+  }
+  seed := mac.Sum(nil)
+
+  // Expand the MAC into one value of 'bits' bits per tag row
+  bits := tagBitsPerElem(p)
+  out := make([]uint64, tagRows(p))
+  for i := range out {
+    prf := hmac.New(sha256.New, seed)
+    binary.LittleEndian.PutUint64(buf[:], uint64(i))
+    prf.Write(buf[:])
+    out[i] = binary.LittleEndian.Uint64(prf.Sum(nil)) & ((1 << bits) - 1)
+  }
+  return out
+}
+
+// Build a copy of 'db' with tag rows appended to every column. Indices
+// of records in the tagged database are the same as in 'db'. Tag entries
+// fill tagBitsPerElem(p) bits, which may be more than the records of 'db'
+// do, so the tagged database's RowLength is the wider of the two (which
+// still fits in one Z_p element).
+func AddIntegrityTags[T matrix.Elem](db *pir.Database[T], key *IntegrityKey) *pir.Database[T] {
+  if db.Info.Ne != 1 {
+    panic("Not yet supported")
+  }
+
+  p := db.Info.P()
+  rows := db.Data.Rows()
+  cols := db.Data.Cols()
+  extra := tagRows(p)
+
+  vals := make([]uint64, (rows + extra) * cols)
+  col := make([]uint64, rows)
+  for j := uint64(0); j < cols; j++ {
+    for i := uint64(0); i < rows; i++ {
+      col[i] = uint64(db.Data.Get(i, j))
+      vals[i*cols + j] = col[i]
+    }
+
+    for i, v := range key.tag(p, j, col) {
+      vals[(rows + uint64(i))*cols + j] = v
+    }
+  }
+
+  rowLength := db.Info.RowLength
+  if bits := tagBitsPerElem(p); bits > rowLength {
+    rowLength = bits
+  }
+
+  tagged := pir.NewDatabaseFixedParams[T](uint64(len(vals)), rowLength, vals, db.Info.Params)
+  if tagged.Info.Ne != 1 {
+    panic("Tag entries do not fit in one Z_p element")
+  }
+  return tagged
+}
+
+// Recover the column of the tagged database that holds record 'i', and
+// check its tag. Returns the column without its tag rows.
+func (c *Client[T]) RecoverVerified(key *IntegrityKey, i uint64, ans *pir.Answer[T]) ([]uint64, error) {
+  p := c.pirClient.GetP()
+  extra := tagRows(p)
+
+  if ans == nil || ans.Answer == nil || ans.Answer.Rows() != c.pirClient.GetL() || ans.Answer.Cols() != 1 {
+    return nil, ErrIntegrity
+  }
+
+  vals := c.Recover(ans)
+  if uint64(len(vals)) <= extra {
+    return nil, ErrIntegrity
+  }
+
+  data := vals[:uint64(len(vals)) - extra]
+  expected := key.tag(p, i % c.pirClient.GetM(), data)
+  if !hmac.Equal(uint64Bytes(expected), uint64Bytes(vals[len(data):])) {
+    return nil, ErrIntegrity
+  }
+
+  return data, nil
+}
+
+// Same as RecoverRecord, for a tagged record database.
+func (c *Client[T]) RecoverRecordVerified(info *RecordInfo, key *IntegrityKey, i uint64, ans *pir.Answer[T]) ([]byte, error) {
+  if i >= info.Num {
+    return nil, ErrRecordIndex
+  }
+  vals, err := c.RecoverVerified(key, i, ans)
+  if err != nil {
+    return nil, err
+  }
+
+  start := (i / info.M) * info.ElemsPerRecord
+  stop := start + info.ElemsPerRecord
+  if stop > uint64(len(vals)) {
+    return nil, ErrMalformedRecord
+  }
+
+  return info.decode(vals[start:stop])
+}
+
+func uint64Bytes(vals []uint64) []byte {
+  out := make([]byte, 8*len(vals))
+  for i, v := range vals {
+    binary.LittleEndian.PutUint64(out[8*i:], v)
+  }
+  return out
+}
@@ -0,0 +1,201 @@
+package underhood
+
+import (
+  "bytes"
+  "errors"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func TestIntegrityTags(t *testing.T) {
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 1, params)
+  key := NewIntegrityKey()
+  tagged := AddIntegrityTags(db, key)
+
+  extra := tagRows(params.P)
+  if extra*tagBitsPerElem(params.P) < TagBits {
+    t.Fatal("Tag is too short")
+  }
+  if tagged.Data.Rows() != db.Data.Rows() + extra {
+    t.Fatal("Wrong number of tag rows")
+  }
+  if tagged.Info.RowLength != tagBitsPerElem(params.P) || tagged.Info.Ne != 1 {
+    t.Fatalf("Tagged database has %d-bit rows in %d elements", tagged.Info.RowLength, tagged.Info.Ne)
+  }
+
+  for i := uint64(0); i < db.Info.Num; i++ {
+    if tagged.GetElem(i) != db.GetElem(i) {
+      t.Fatalf("Record %v moved", i)
+    }
+  }
+
+  col := make([]uint64, tagged.Data.Rows())
+  for i := range col {
+    col[i] = uint64(tagged.Data.Get(uint64(i), 5))
+  }
+  data := col[:db.Data.Rows()]
+  if !bytes.Equal(uint64Bytes(key.tag(params.P, 5, data)), uint64Bytes(col[len(data):])) {
+    t.Fail()
+  }
+  if bytes.Equal(uint64Bytes(key.tag(params.P, 6, data)), uint64Bytes(col[len(data):])) {
+    t.Fail()
+  }
+}
+
+func testVerifiedPIR[IntT matrix.Elem](t *testing.T, dbSize uint64) {
+  pMod := uint64(512)
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), 1<<10, pMod)
+  db := pir.NewDatabaseRandomFixedParams[IntT](rand.NewRandomBufPRG(), dbSize, 1, params)
+  key := NewIntegrityKey()
+  tagged := AddIntegrityTags(db, key)
+
+  server := NewServer(tagged, seed)
+  defer server.Free()
+
+  // A server for a different database, whose tokens do not match
+  other := NewServer(AddIntegrityTags(db.Copy(), key), rand.RandomPRGKey())
+  defer other.Free()
+
+  idx := uint64(7)
+  for run := 0; run < 4; run++ {
+    client := NewClient[IntT](seed, tagged.Info)
+    defer client.Free()
+
+    hq := client.HintQuery()
+    hans, err := server.HintAnswer(hq)
+    if run == 1 {
+      hans, err = other.HintAnswer(hq)
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err := client.HintRecover(hans); err != nil {
+      t.Fatal(err)
+    }
+    client.PreprocessQuery()
+
+    q, err := client.Query(idx)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    checkIdx := idx
+    switch run {
+    case 2:
+      // Corrupt one entry of the answer
+      ans.Answer.AddAt(3, 0, IntT(tagged.Info.Params.Delta))
+    case 3:
+      // Check against a different column
+      checkIdx = idx + 1
+    }
+
+    vals, err := client.RecoverVerified(key, checkIdx, ans)
+    if run == 0 {
+      if err != nil {
+        t.Fatal(err)
+      }
+      for row := uint64(0); row < db.Info.L; row++ {
+        if db.GetElem(row * db.Info.M + idx) != vals[row] {
+          t.Fail()
+        }
+      }
+    } else if !errors.Is(err, ErrIntegrity) {
+      t.Errorf("Run %v: expected ErrIntegrity, got %v", run, err)
+    }
+  }
+}
+
+func TestVerifiedPIRSmall64(t *testing.T) {
+  testVerifiedPIR[matrix.Elem64](t, 1<<10)
+}
+
+func TestVerifiedPIRMed64(t *testing.T) {
+  testVerifiedPIR[matrix.Elem64](t, 1<<16)
+}
+
+func TestVerifiedPIRSmall32(t *testing.T) {
+  testVerifiedPIR[matrix.Elem32](t, 1<<10)
+}
+
+func TestVerifiedPIRMed32(t *testing.T) {
+  testVerifiedPIR[matrix.Elem32](t, 1<<16)
+}
+
+func TestVerifiedRecord(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  recs := randRecords(1<<11, 50)
+  db, info := NewRecordDatabase[matrix.Elem64](recs, params)
+  key := NewIntegrityKey()
+  tagged := AddIntegrityTags(db, key)
+
+  server := NewServer(tagged, seed)
+  defer server.Free()
+
+  client := NewClient[matrix.Elem64](seed, tagged.Info)
+  defer client.Free()
+
+  hans, err := server.HintAnswer(client.HintQuery())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  idx := uint64(1500)
+  q, err := client.QueryRecord(info, idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  rec, err := client.RecoverRecordVerified(info, key, idx, ans)
+  if err != nil || !bytes.Equal(rec, recs[idx]) {
+    t.Fail()
+  }
+}
+
+func TestHintRecoverMalformed(t *testing.T) {
+  server, client := smallServer[matrix.Elem64]()
+  defer server.Free()
+  defer client.Free()
+
+  hans, err := server.HintAnswer(client.HintQuery())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  badRows := *hans
+  badRows.MatrixRows += 1
+
+  badLimbs := *hans
+  badLimbs.HintCts = hans.HintCts[1:]
+
+  badCt := *hans
+  badCt.HintCts = append([][]CipherBlob{}, hans.HintCts...)
+  badCt.HintCts[0] = []CipherBlob{ hans.HintCts[0][0][:100] }
+
+  for _, a := range []*HintAnswer{ nil, &badRows, &badLimbs, &badCt } {
+    if err := client.HintRecover(a); !errors.Is(err, ErrBadHintAnswer) {
+      t.Errorf("Expected ErrBadHintAnswer, got %v", err)
+    }
+  }
+
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+}
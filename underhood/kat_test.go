@@ -0,0 +1,244 @@
+package underhood
+
+import (
+  "os"
+  "flag"
+  "testing"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "encoding/binary"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+// Known-answer tests for the token protocol. Each vector fixes the
+// database, the matrix A seed and the client's seed, and records SHA-256
+// digests of the client's secret, its HintQuery, the server's HintAnswer
+// and the recovered token (H x s, over the top limbs of the hint).
+//
+// To (re)record the vectors, run: go test -run KAT -update
+// The secret and token digests depend only on Go code; the HintQuery and
+// HintAnswer digests also depend on SEAL, so record them on a build
+// against SEAL 4.1 (not a stand-in backend). A test with an empty digest
+// checks the others, and then skips.
+
+var updateKAT = flag.Bool("update", false, "rewrite the known-answer test vectors")
+
+const katFile = "testdata/token_kat.json"
+
+type katVector struct {
+  Bits       uint64 `json:"bits"`
+  Num        uint64 `json:"num"`
+  RowLength  uint64 `json:"row_length"`
+  P          uint64 `json:"p"`
+  Samples    uint64 `json:"samples"`
+  DBSeed     string `json:"db_seed"`
+  MatrixSeed string `json:"matrix_seed"`
+  ClientSeed string `json:"client_seed"`
+
+  Secret     string `json:"secret_sha256"`
+  HintQuery  string `json:"hint_query_sha256"`
+  HintAnswer string `json:"hint_answer_sha256"`
+  Token      string `json:"token_sha256"`
+}
+
+func loadKAT(t *testing.T) []katVector {
+  data, err := os.ReadFile(katFile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var vecs []katVector
+  if err := json.Unmarshal(data, &vecs); err != nil {
+    t.Fatal(err)
+  }
+  return vecs
+}
+
+func storeKAT(t *testing.T, vecs []katVector) {
+  data, err := json.MarshalIndent(vecs, "", "  ")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(katFile, append(data, '\n'), 0644); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func decodeHex(t *testing.T, s string, out []byte) {
+  b, err := hex.DecodeString(s)
+  if err != nil || len(b) != len(out) {
+    t.Fatalf("Bad seed %q", s)
+  }
+  copy(out, b)
+}
+
+func katDatabase[T matrix.Elem](t *testing.T, v *katVector) (*pir.Database[T], *rand.PRGKey, *rlwe.Seed) {
+  var dbSeed, matrixSeed rand.PRGKey
+  var clientSeed rlwe.Seed
+  decodeHex(t, v.DBSeed, dbSeed[:])
+  decodeHex(t, v.MatrixSeed, matrixSeed[:])
+  decodeHex(t, v.ClientSeed, clientSeed[:])
+
+  params := lwe.NewParamsFixedP(v.Bits, v.Samples, v.P)
+  prg := rand.NewBufPRG(rand.NewPRG(&dbSeed))
+  db := pir.NewDatabaseRandomFixedParams[T](prg, v.Num, v.RowLength, params)
+  return db, &matrixSeed, &clientSeed
+}
+
+func digestMatrix[T matrix.Elem](m *matrix.Matrix[T]) string {
+  h := sha256.New()
+  var buf [8]byte
+  binary.LittleEndian.PutUint64(buf[:], m.Rows())
+  h.Write(buf[:])
+  binary.LittleEndian.PutUint64(buf[:], m.Cols())
+  h.Write(buf[:])
+  for _, v := range m.Data() {
+    binary.LittleEndian.PutUint64(buf[:], uint64(v))
+    h.Write(buf[:])
+  }
+  return hex.EncodeToString(h.Sum(nil))
+}
+
+func digestBlobs(h interface{ Write([]byte) (int, error) }, blobs []CipherBlob) {
+  var buf [8]byte
+  binary.LittleEndian.PutUint64(buf[:], uint64(len(blobs)))
+  h.Write(buf[:])
+  for _, b := range blobs {
+    binary.LittleEndian.PutUint64(buf[:], uint64(len(b)))
+    h.Write(buf[:])
+    h.Write(b)
+  }
+}
+
+// The token that the protocol should recover: H x s, where H keeps only
+// the top limbs of each hint entry.
+func expectedToken[T matrix.Elem](hint, secret *matrix.Matrix[T]) *matrix.Matrix[T] {
+  dropped := T(0).Bitlen() - uint64(numLimbs[T]()*BitsPerLimb)
+  top := hint.Copy()
+  data := top.Data()
+  for i := range data {
+    data[i] = (data[i] >> dropped) << dropped
+  }
+  return matrix.Mul(top, secret)
+}
+
+// Run the token protocol on one vector, and fill in its digests.
+func runKAT[T matrix.Elem](t *testing.T, v *katVector) katVector {
+  db, matrixSeed, clientSeed := katDatabase[T](t, v)
+  server := NewServer(db, matrixSeed)
+  defer server.Free()
+  client := NewClientForTesting[T](matrixSeed, db.Info, clientSeed)
+  defer client.Free()
+
+  out := *v
+  hq := client.HintQuery()
+  h := sha256.New()
+  digestBlobs(h, *hq)
+  out.HintQuery = hex.EncodeToString(h.Sum(nil))
+
+  ans, err := server.HintAnswer(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  h = sha256.New()
+  var buf [8]byte
+  binary.LittleEndian.PutUint64(buf[:], ans.MatrixRows)
+  h.Write(buf[:])
+  for _, lst := range ans.HintCts {
+    digestBlobs(h, lst)
+  }
+  out.HintAnswer = hex.EncodeToString(h.Sum(nil))
+
+  if err := client.HintRecover(ans); err != nil {
+    t.Fatal(err)
+  }
+  out.Secret = digestMatrix(client.tokens.Secret())
+  out.Token = digestMatrix(client.interm)
+  return out
+}
+
+// The digests that do not depend on SEAL, computed directly.
+func referenceKAT[T matrix.Elem](t *testing.T, v *katVector) katVector {
+  db, matrixSeed, clientSeed := katDatabase[T](t, v)
+  hint := pir.NewServerSeed(db, matrixSeed).Hint()
+
+  prg := rand.NewBufPRG(rand.NewPRG(derivePRGKey(clientSeed, "secrets")))
+  secret := matrix.Ternary[T](prg, db.Info.Params.N, 1)
+
+  out := *v
+  out.Secret = digestMatrix(secret)
+  out.Token = digestMatrix(expectedToken(hint, secret))
+  return out
+}
+
+// Check (or, with -update, record) the listed digests of each vector.
+func testKAT(t *testing.T, run func(*testing.T, *katVector) katVector, fields []string) {
+  vecs := loadKAT(t)
+  missing := 0
+  for i := range vecs {
+    if vecs[i].Bits != 32 && vecs[i].Bits != 64 {
+      t.Fatalf("Vector %d: bad width %d", i, vecs[i].Bits)
+    }
+
+    got := run(t, &vecs[i])
+    for _, f := range fields {
+      var g, w *string
+      switch f {
+      case "secret":
+        g, w = &got.Secret, &vecs[i].Secret
+      case "token":
+        g, w = &got.Token, &vecs[i].Token
+      case "hint_query":
+        g, w = &got.HintQuery, &vecs[i].HintQuery
+      case "hint_answer":
+        g, w = &got.HintAnswer, &vecs[i].HintAnswer
+      }
+
+      if *updateKAT {
+        *w = *g
+      } else if *w == "" {
+        t.Logf("Vector %d: no %s digest recorded: %s", i, f, *g)
+        missing += 1
+      } else if *g != *w {
+        t.Errorf("Vector %d: %s digest is %s, want %s", i, f, *g, *w)
+      }
+    }
+  }
+
+  if *updateKAT {
+    storeKAT(t, vecs)
+  } else if missing > 0 {
+    t.Skipf("%d digests not recorded (run with -update on a SEAL build)", missing)
+  }
+}
+
+func dispatchKAT(run32, run64 func(*testing.T, *katVector) katVector) func(*testing.T, *katVector) katVector {
+  return func(t *testing.T, v *katVector) katVector {
+    if v.Bits == 32 {
+      return run32(t, v)
+    }
+    return run64(t, v)
+  }
+}
+
+// Checks the secret and token digests without running SEAL.
+func TestTokenKATReference(t *testing.T) {
+  testKAT(t, dispatchKAT(referenceKAT[matrix.Elem32], referenceKAT[matrix.Elem64]),
+          []string{ "secret", "token" })
+}
+
+func TestTokenKAT(t *testing.T) {
+  run := dispatchKAT(runKAT[matrix.Elem32], runKAT[matrix.Elem64])
+
+  // The protocol is deterministic given the seeds
+  vecs := loadKAT(t)
+  if a, b := run(t, &vecs[0]), run(t, &vecs[0]); a != b {
+    t.Error("Token protocol is not deterministic")
+  }
+
+  testKAT(t, run, []string{ "secret", "token", "hint_query", "hint_answer" })
+}
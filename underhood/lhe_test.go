@@ -26,17 +26,28 @@ func testLHE[IntT matrix.Elem](t *testing.T, dbSize uint64, runs int) {
     // Token-generation phase
     hq := client.HintQuery()
     start := time.Now()
-    hans := server.HintAnswer(hq)
+    hans, err := server.HintAnswer(hq)
+    if err != nil {
+      t.Fatal(err)
+    }
     elapsed := time.Since(start)
     log.Printf(" HintApply: %v\n", elapsed)
-    client.HintRecover(hans)
+    if err := client.HintRecover(hans); err != nil {
+      t.Fatal(err)
+    }
     client.PreprocessQueryLHE()
 
     // Query phase
     rng := rand.NewRandomBufPRG()
     msg := matrix.Rand[IntT](rng, db.Info.M, 1, db.Info.P())
-    q := client.QueryLHE(msg)
-    ans := server.Answer(q)
+    q, err := client.QueryLHE(msg)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
     msg2 := client.RecoverLHE(ans)
 
     msg3 := matrix.Mul(db.Data, msg)
@@ -116,20 +127,35 @@ func testLHEMixed(t *testing.T, dbSize uint64) {
 
   // Token-generation phase
   hq := client64.HintQuery()
-  client32.CopySecret(client64)
-  toDrop := int(db64.Info.Params.N - db32.Info.Params.N)
-  *hq = (*hq)[:len(*hq)-toDrop]
-  hans := server.HintAnswer(hq)
+  if err := ShareToken(client64, client32); err != nil {
+    t.Fatal(err)
+  }
+  hq32, err := SliceHintQuery(hq, client64.SecretDim(), client32.SecretDim())
+  if err != nil {
+    t.Fatal(err)
+  }
+  hans, err := server.HintAnswer(hq32)
+  if err != nil {
+    t.Fatal(err)
+  }
 
-  client32.HintRecover(hans)
+  if err := client32.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
   client32.PreprocessQueryLHE()
 
   // Query phase
   rng := rand.NewRandomBufPRG()
   msg := matrix.Rand[matrix.Elem32](rng, db32.Info.M, 1, db32.Info.P())
 
-  q := client32.QueryLHE(msg)
-  ans := server.Answer(q)
+  q, err := client32.QueryLHE(msg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
   msg2 := client32.RecoverLHE(ans)
 
   msg3 := matrix.Mul(db32.Data, msg)
@@ -146,3 +172,147 @@ func testLHEMixed(t *testing.T, dbSize uint64) {
 func TestMixedSmall(t *testing.T) {
   testLHEMixed(t, 1<<10)
 }
+
+func testLHEMany[IntT matrix.Elem](t *testing.T, dbSize, k uint64) {
+  pMod := uint64(512)
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), 1<<10, pMod)
+  db := pir.NewDatabaseRandomFixedParams[IntT](rand.NewRandomBufPRG(), dbSize, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  client := NewClient[IntT](seed, db.Info)
+  defer client.Free()
+
+  // Token-generation phase
+  hq := client.HintQueryMany(k)
+  hans, err := server.HintAnswer(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQueryLHEMany()
+
+  // Query phase
+  rng := rand.NewRandomBufPRG()
+  msg := matrix.Rand[IntT](rng, db.Info.M, k, db.Info.P())
+  q, err := client.QueryLHEMany(msg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.AnswerMany(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  msg2 := client.RecoverLHEMany(ans)
+
+  msg3 := matrix.Mul(db.Data, msg)
+  msg3.ModConst(IntT(db.Info.P()))
+
+  if !msg2.Equals(msg3) {
+    t.Fail()
+  }
+}
+
+func TestEncryptionManySmall64(t *testing.T) {
+  testLHEMany[matrix.Elem64](t, 1<<10, 4)
+}
+
+func TestEncryptionManyMed64(t *testing.T) {
+  testLHEMany[matrix.Elem64](t, 1<<16, 3)
+}
+
+func TestEncryptionManySmall32(t *testing.T) {
+  testLHEMany[matrix.Elem32](t, 1<<10, 4)
+}
+
+func TestEncryptionManyMed32(t *testing.T) {
+  testLHEMany[matrix.Elem32](t, 1<<16, 3)
+}
+
+// AnswerMany gives what one Answer per column would.
+func testAnswerMany[T matrix.Elem](t *testing.T, dbSize, k uint64) {
+  params := lwe.NewParamsFixedP(T(0).Bitlen(), 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[T](rand.NewRandomBufPRG(), dbSize, 1, params)
+  server := answerOnlyServer(db)
+  info := server.pirServer.DBInfo()
+  rows := ((info.M + info.Squishing - 1) / info.Squishing) * info.Squishing
+  q := &pir.Query[T]{ Query: matrix.Rand[T](rand.NewRandomBufPRG(), rows, k, 0) }
+
+  // The blocks are only built for AnswerMany
+  if server.blocks != nil {
+    t.Fatal("Blocks were built before the first AnswerMany")
+  }
+  ans, err := server.AnswerMany(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if server.blocks == nil || server.data != nil {
+    t.Fatal("AnswerMany did not build the blocks")
+  }
+  if !ans.Answer.Equals(server.answerManyReference(q)) {
+    t.Fatalf("AnswerMany differs from Answer (%d elements, %d columns)", dbSize, k)
+  }
+}
+
+func TestAnswerMany(t *testing.T) {
+  for _, k := range []uint64{ 1, 5, MaxSecretsPerQuery } {
+    testAnswerMany[matrix.Elem64](t, 1000, k)
+    testAnswerMany[matrix.Elem32](t, 100000, k)
+  }
+}
+
+func TestEncryptionReuse(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<10, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  client := NewClient[matrix.Elem64](seed, db.Info)
+  defer client.Free()
+
+  hans, err := server.HintAnswer(client.HintQuery())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQueryLHE()
+
+  rng := rand.NewRandomBufPRG()
+  msg := matrix.Rand[matrix.Elem64](rng, db.Info.M, 1, db.Info.P())
+  if _, err := client.QueryLHE(msg); err != nil {
+    t.Fatal(err)
+  }
+
+  // A second query under the same secret is refused...
+  if _, err := client.QueryLHE(msg); err != ErrTokenUsed {
+    t.Fatalf("Expected ErrTokenUsed, got %v", err)
+  }
+
+  // ... unless in unsafe mode, where each query is still correct.
+  client.AllowUnsafeReuse()
+  for run := 0; run < 2; run++ {
+    msg := matrix.Rand[matrix.Elem64](rng, db.Info.M, 1, db.Info.P())
+    q, err := client.QueryLHE(msg)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    expected := matrix.Mul(db.Data, msg)
+    expected.ModConst(matrix.Elem64(db.Info.P()))
+    if !client.RecoverLHE(ans).Equals(expected) {
+      t.Fail()
+    }
+  }
+}
@@ -0,0 +1,357 @@
+package underhood
+
+import (
+  "io"
+  "fmt"
+  "math"
+  "bytes"
+  "bufio"
+  "errors"
+  "strconv"
+  "strings"
+  "encoding/csv"
+  "encoding/binary"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// Loaders that build a database from a file or stream. The input is read
+// incrementally, but it is only streamed into the database matrix if its
+// size is known ahead of time:
+// - LoadLines, LoadCSV and LoadBinary stream only if LoadOptions gives
+//   both Num and RowLength. Otherwise, they buffer all of the values (as
+//   integers, not as text) to find their number and width.
+// - LoadRecords streams if it is given the LWE parameters, or if it can
+//   seek to the end of its input to count the records. Otherwise (e.g., on
+//   a pipe), it buffers the whole input.
+
+var ErrBadInput = errors.New("underhood: malformed database input")
+
+// Set both Num and RowLength to stream large inputs (see above).
+type LoadOptions struct {
+  Num       uint64      // number of values (0 if unknown)
+  RowLength uint64      // bits per value (0 to use the width of the largest value)
+  Params    *lwe.Params // LWE parameters (nil to choose them automatically)
+}
+
+// A source of database values. next() returns io.EOF after the last value.
+type valueReader interface {
+  next() (uint64, error)
+}
+
+// Newline-delimited unsigned integers (blank lines are skipped).
+type lineValues struct {
+  scanner *bufio.Scanner
+  line    int
+}
+
+func (r *lineValues) next() (uint64, error) {
+  for r.scanner.Scan() {
+    r.line += 1
+    text := strings.TrimSpace(r.scanner.Text())
+    if text == "" {
+      continue
+    }
+    v, err := strconv.ParseUint(text, 10, 64)
+    if err != nil {
+      return 0, fmt.Errorf("%w: line %d: %v", ErrBadInput, r.line, err)
+    }
+    return v, nil
+  }
+
+  if err := r.scanner.Err(); err != nil {
+    return 0, err
+  }
+  return 0, io.EOF
+}
+
+// Unsigned integers in CSV format, read row by row.
+type csvValues struct {
+  reader *csv.Reader
+  fields []string
+}
+
+func (r *csvValues) next() (uint64, error) {
+  for len(r.fields) == 0 {
+    fields, err := r.reader.Read()
+    if err == io.EOF {
+      return 0, io.EOF
+    } else if err != nil {
+      return 0, fmt.Errorf("%w: %v", ErrBadInput, err)
+    }
+    r.fields = fields
+  }
+
+  text := strings.TrimSpace(r.fields[0])
+  r.fields = r.fields[1:]
+  v, err := strconv.ParseUint(text, 10, 64)
+  if err != nil {
+    line, _ := r.reader.FieldPos(0)
+    return 0, fmt.Errorf("%w: line %d: %v", ErrBadInput, line, err)
+  }
+  return v, nil
+}
+
+// Little-endian unsigned integers of 'size' bytes each.
+type binaryValues struct {
+  reader *bufio.Reader
+  size   int
+  buf    [8]byte
+}
+
+func (r *binaryValues) next() (uint64, error) {
+  r.buf = [8]byte{}
+  n, err := io.ReadFull(r.reader, r.buf[:r.size])
+  if err == io.EOF {
+    return 0, io.EOF
+  } else if err == io.ErrUnexpectedEOF {
+    return 0, fmt.Errorf("%w: trailing %d bytes", ErrBadInput, n)
+  } else if err != nil {
+    return 0, err
+  }
+  return binary.LittleEndian.Uint64(r.buf[:]), nil
+}
+
+// Read newline-delimited unsigned integers.
+func LoadLines[T matrix.Elem](r io.Reader, opts LoadOptions) (*pir.Database[T], error) {
+  return loadValues[T](&lineValues{ scanner: bufio.NewScanner(r) }, opts)
+}
+
+// Read unsigned integers in CSV format. All fields of all rows are taken
+// in order, so rows may hold any number of values.
+func LoadCSV[T matrix.Elem](r io.Reader, opts LoadOptions) (*pir.Database[T], error) {
+  reader := csv.NewReader(r)
+  reader.FieldsPerRecord = -1
+  reader.ReuseRecord = true
+  return loadValues[T](&csvValues{ reader: reader }, opts)
+}
+
+// Read raw little-endian unsigned integers of 'size' bytes each.
+func LoadBinary[T matrix.Elem](r io.Reader, size int, opts LoadOptions) (*pir.Database[T], error) {
+  if size <= 0 || size > 8 {
+    panic("Values must have between 1 and 8 bytes")
+  }
+  if opts.RowLength == 0 {
+    opts.RowLength = uint64(8 * size)
+  }
+  return loadValues[T](&binaryValues{ reader: bufio.NewReader(r), size: size }, opts)
+}
+
+// Read fixed-size records of 'size' bytes each, and lay them out as in
+// NewRecordDatabase. Each record is encoded straight into the database
+// matrix as it is read. If 'params' is nil, they are chosen automatically:
+// this needs the number of records, which LoadRecords finds by seeking to
+// the end of 'r' if it can, and otherwise by reading all of 'r' into
+// memory. To stream a large input that can't seek, pass 'params'.
+func LoadRecords[T matrix.Elem](r io.Reader, size int, params *lwe.Params) (*pir.Database[T], *RecordInfo, error) {
+  if size <= 0 {
+    panic("Records must be non-empty")
+  }
+  if uint64(size) >= (1 << (8*recordHeaderLen)) {
+    return nil, nil, fmt.Errorf("%w: records of %d bytes are too long", ErrBadInput, size)
+  }
+
+  if params == nil {
+    num, rest, err := countRecords(r, size)
+    if err != nil {
+      return nil, nil, err
+    }
+    if num == 0 {
+      return nil, nil, fmt.Errorf("%w: no records", ErrBadInput)
+    }
+
+    params, err = chooseParams[T](num, 8 * uint64(recordHeaderLen + size))
+    if err != nil {
+      return nil, nil, err
+    }
+    r = rest
+  }
+
+  return streamRecords[T](bufio.NewReader(r), size, params)
+}
+
+// The number of (whole) records left in 'r', and a reader for them.
+func countRecords(r io.Reader, size int) (uint64, io.Reader, error) {
+  if s, ok := r.(io.Seeker); ok {
+    // Seeking fails on pipes: then fall back to buffering
+    if cur, err := s.Seek(0, io.SeekCurrent); err == nil {
+      end, err := s.Seek(0, io.SeekEnd)
+      if err != nil {
+        return 0, nil, err
+      }
+      if _, err := s.Seek(cur, io.SeekStart); err != nil {
+        return 0, nil, err
+      }
+      return uint64(end - cur) / uint64(size), r, nil
+    }
+  }
+
+  buf, err := io.ReadAll(r)
+  if err != nil {
+    return 0, nil, err
+  }
+  return uint64(len(buf)) / uint64(size), bytes.NewReader(buf), nil
+}
+
+// Encode each record into the database matrix as it is read. The matrix
+// grows by one block of ElemsPerRecord rows (which holds M records) at a
+// time.
+func streamRecords[T matrix.Elem](r *bufio.Reader, size int, params *lwe.Params) (*pir.Database[T], *RecordInfo, error) {
+  info := newRecordInfo(0, uint64(size), params)
+  k := info.ElemsPerRecord
+  data := matrix.Zeros[T](0, info.M)
+
+  rec := make([]byte, size)
+  for ; ; info.Num++ {
+    n, err := io.ReadFull(r, rec)
+    if err == io.EOF {
+      break
+    } else if err == io.ErrUnexpectedEOF {
+      return nil, nil, fmt.Errorf("%w: trailing %d bytes", ErrBadInput, n)
+    } else if err != nil {
+      return nil, nil, err
+    }
+
+    col := info.Num % info.M
+    if col == 0 {
+      data.Concat(matrix.Zeros[T](k, info.M))
+    }
+    start := (info.Num / info.M) * k
+    for j, v := range info.encode(rec) {
+      data.Set(start + uint64(j), col, T(v))
+    }
+  }
+
+  if info.Num == 0 {
+    return nil, nil, fmt.Errorf("%w: no records", ErrBadInput)
+  }
+
+  db := new(pir.Database[T])
+  db.Info = pir.NewDBInfoFixedParams(data.Rows() * info.M, info.BitsPerElem, params, true)
+  db.Info.Num = info.Num * k
+  db.Data = data
+  return db, info, nil
+}
+
+// The LWE parameters that pir.NewDBInfo picks for 'num' values of
+// 'rowLength' bits. Returns an error (where pir.NewDBInfo panics) if the
+// database is too large or too wide for any of them.
+func chooseParams[T matrix.Elem](num, rowLength uint64) (*lwe.Params, error) {
+  // As pir.NewDBInfo: lay out the database for p = 256, then take the
+  // parameters for its width
+  ne := uint64(1)
+  if rowLength > 8 {
+    ne = pir.Compute_num_entries_base_p(256, rowLength)
+  }
+  if num > math.MaxUint64 / ne {
+    return nil, fmt.Errorf("%w: %d values of %d bits are too many", ErrBadInput, num, rowLength)
+  }
+
+  elems := num * ne
+  l := uint64(math.Sqrt(float64(elems)))
+  if l % ne != 0 {
+    l += ne - (l % ne)
+  }
+  if lwe.NewParams(T(0).Bitlen(), (elems + l - 1) / l) == nil {
+    return nil, fmt.Errorf("%w: %d values of %d bits are too many for the LWE parameters",
+                           ErrBadInput, num, rowLength)
+  }
+
+  return pir.NewDBInfo(T(0).Bitlen(), num, rowLength).Params, nil
+}
+
+func bitLength(v uint64) uint64 {
+  bits := uint64(1)
+  for bits < 64 && (v >> bits) != 0 {
+    bits += 1
+  }
+  return bits
+}
+
+func loadValues[T matrix.Elem](src valueReader, opts LoadOptions) (*pir.Database[T], error) {
+  if opts.Num > 0 && opts.RowLength > 0 {
+    return streamValues[T](src, opts)
+  }
+
+  // Buffer the values, to find their number and width
+  var vals []uint64
+  maxBits := uint64(1)
+  for {
+    v, err := src.next()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      return nil, err
+    }
+    vals = append(vals, v)
+    if b := bitLength(v); b > maxBits {
+      maxBits = b
+    }
+  }
+
+  if opts.Num > 0 && opts.Num != uint64(len(vals)) {
+    return nil, fmt.Errorf("%w: got %d values, want %d", ErrBadInput, len(vals), opts.Num)
+  }
+  if len(vals) == 0 {
+    return nil, fmt.Errorf("%w: no values", ErrBadInput)
+  }
+
+  if opts.RowLength == 0 {
+    opts.RowLength = maxBits
+  } else if maxBits > opts.RowLength {
+    return nil, fmt.Errorf("%w: value does not fit in %d bits", ErrBadInput, opts.RowLength)
+  }
+
+  num := uint64(len(vals))
+  params := opts.Params
+  if params == nil {
+    var err error
+    if params, err = chooseParams[T](num, opts.RowLength); err != nil {
+      return nil, err
+    }
+  }
+  return pir.NewDatabaseFixedParams[T](num, opts.RowLength, vals, params), nil
+}
+
+// Write each value into the database matrix as it is read, with the same
+// layout as pir.NewDatabaseFixedParams.
+func streamValues[T matrix.Elem](src valueReader, opts LoadOptions) (*pir.Database[T], error) {
+  params := opts.Params
+  if params == nil {
+    var err error
+    if params, err = chooseParams[T](opts.Num, opts.RowLength); err != nil {
+      return nil, err
+    }
+  }
+
+  db := new(pir.Database[T])
+  db.Info = pir.NewDBInfoFixedParams(opts.Num, opts.RowLength, params, true)
+  db.Data = matrix.Zeros[T](db.Info.L, db.Info.M)
+
+  p := db.Info.P()
+  ne := db.Info.Ne
+  m := db.Info.M
+  for i := uint64(0); ; i++ {
+    v, err := src.next()
+    if err == io.EOF {
+      if i != opts.Num {
+        return nil, fmt.Errorf("%w: got %d values, want %d", ErrBadInput, i, opts.Num)
+      }
+      return db, nil
+    } else if err != nil {
+      return nil, err
+    }
+
+    if i >= opts.Num {
+      return nil, fmt.Errorf("%w: more than %d values", ErrBadInput, opts.Num)
+    }
+    if bitLength(v) > opts.RowLength {
+      return nil, fmt.Errorf("%w: value %d does not fit in %d bits", ErrBadInput, i, opts.RowLength)
+    }
+
+    for j := uint64(0); j < ne; j++ {
+      db.Data.Set((i/m)*ne + j, i % m, T(pir.Base_p(p, v, j)))
+    }
+  }
+}
@@ -0,0 +1,201 @@
+package underhood
+
+import (
+  "io"
+  "bytes"
+  "errors"
+  "strconv"
+  "strings"
+  "testing"
+  mrand "math/rand"
+  "encoding/binary"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func randValues(num int, bits uint) []uint64 {
+  r := mrand.New(mrand.NewSource(7))
+  out := make([]uint64, num)
+  for i := range out {
+    out[i] = r.Uint64() >> (64 - bits)
+  }
+  return out
+}
+
+func checkValues[T matrix.Elem](t *testing.T, db *pir.Database[T], err error, vals []uint64) {
+  if err != nil {
+    t.Fatal(err)
+  }
+  if db.Info.Num != uint64(len(vals)) {
+    t.Fatalf("Got %v values, want %v", db.Info.Num, len(vals))
+  }
+  for i, v := range vals {
+    if db.GetElem(uint64(i)) != v {
+      t.Fatalf("Value %v: got %v, want %v", i, db.GetElem(uint64(i)), v)
+    }
+  }
+}
+
+func TestLoadLines(t *testing.T) {
+  vals := randValues(5000, 20)
+  var text strings.Builder
+  for i, v := range vals {
+    text.WriteString(strconv.FormatUint(v, 10))
+    text.WriteString("\n")
+    if i % 100 == 0 {
+      text.WriteString("\n")
+    }
+  }
+
+  // Number and width found automatically
+  db, err := LoadLines[matrix.Elem64](strings.NewReader(text.String()), LoadOptions{})
+  checkValues(t, db, err, vals)
+
+  // Streamed straight into the database, with given parameters
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  opts := LoadOptions{ Num: uint64(len(vals)), RowLength: 20, Params: params }
+  db, err = LoadLines[matrix.Elem64](strings.NewReader(text.String()), opts)
+  checkValues(t, db, err, vals)
+
+  expected := pir.NewDatabaseFixedParams[matrix.Elem64](uint64(len(vals)), 20, vals, params)
+  if !db.Data.Equals(expected.Data) {
+    t.Fatal("Layout differs from pir.NewDatabaseFixedParams")
+  }
+
+  db32, err := LoadLines[matrix.Elem32](strings.NewReader(text.String()), LoadOptions{ RowLength: 24 })
+  checkValues(t, db32, err, vals)
+}
+
+func TestLoadCSV(t *testing.T) {
+  vals := randValues(1000, 8)
+  var text strings.Builder
+  for i, v := range vals {
+    text.WriteString(strconv.FormatUint(v, 10))
+    if i % 7 == 6 {
+      text.WriteString("\n")
+    } else if i < len(vals)-1 {
+      text.WriteString(", ")
+    }
+  }
+
+  db, err := LoadCSV[matrix.Elem32](strings.NewReader(text.String()), LoadOptions{})
+  checkValues(t, db, err, vals)
+  if db.Info.RowLength != 8 {
+    t.Fatalf("Got row length %v, want 8", db.Info.RowLength)
+  }
+}
+
+func TestLoadBinary(t *testing.T) {
+  vals := randValues(3000, 16)
+  buf := make([]byte, 2*len(vals))
+  for i, v := range vals {
+    binary.LittleEndian.PutUint16(buf[2*i:], uint16(v))
+  }
+
+  opts := LoadOptions{ Num: uint64(len(vals)) }
+  db, err := LoadBinary[matrix.Elem64](bytes.NewReader(buf), 2, opts)
+  checkValues(t, db, err, vals)
+
+  opts = LoadOptions{ Num: uint64(len(vals)), RowLength: 16 }
+  db, err = LoadBinary[matrix.Elem64](bytes.NewReader(buf), 2, opts)
+  checkValues(t, db, err, vals)
+}
+
+func TestLoadRecords(t *testing.T) {
+  recs := randRecords(500, 30)
+  var buf []byte
+  for i := range recs {
+    rec := make([]byte, 30)
+    copy(rec, recs[i])
+    recs[i] = rec
+    buf = append(buf, rec...)
+  }
+
+  // From a reader that can seek, one that can't, and with fixed parameters
+  params := pir.NewDBInfo(64, uint64(len(recs)), 8*(recordHeaderLen + 30)).Params
+  for _, c := range []struct {
+    r      io.Reader
+    params *lwe.Params
+  }{
+    { bytes.NewReader(buf), nil },
+    { struct{ io.Reader }{ bytes.NewReader(buf) }, nil },
+    { struct{ io.Reader }{ bytes.NewReader(buf) }, params },
+  } {
+    db, info, err := LoadRecords[matrix.Elem64](c.r, 30, c.params)
+    if err != nil {
+      t.Fatal(err)
+    }
+    checkRecords(t, db, info, recs)
+
+    // The same database as NewRecordDatabase builds
+    want, _ := NewRecordDatabase[matrix.Elem64](recs, db.Info.Params)
+    if !db.Data.Equals(want.Data) || db.Info.L != want.Info.L || db.Info.M != want.Info.M || db.Info.Num != want.Info.Num {
+      t.Fatal("Database differs from NewRecordDatabase")
+    }
+  }
+}
+
+func checkRecords(t *testing.T, db *pir.Database[matrix.Elem64], info *RecordInfo, recs [][]byte) {
+  if info.Num != uint64(len(recs)) || db.Info.Params == nil ||
+     db.Info.Num != info.Num * info.ElemsPerRecord || db.Data.Rows() != db.Info.L {
+    t.Fatal("Bad database")
+  }
+
+  for i, rec := range recs {
+    col := uint64(i) % info.M
+    start := (uint64(i) / info.M) * info.ElemsPerRecord
+    vals := make([]uint64, info.ElemsPerRecord)
+    for j := range vals {
+      vals[j] = uint64(db.Data.Get(start + uint64(j), col))
+    }
+
+    dec, err := info.decode(vals)
+    if err != nil || !bytes.Equal(dec, rec) {
+      t.Fatalf("Record %v: decoding failed", i)
+    }
+  }
+}
+
+func TestLoadMalformed(t *testing.T) {
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+
+  for _, c := range []struct {
+    text string
+    opts LoadOptions
+  }{
+    { "", LoadOptions{} },
+    { "1\n2\nthree\n", LoadOptions{} },
+    { "1\n-2\n", LoadOptions{} },
+    { "1\n2\n3\n", LoadOptions{ Num: 2, RowLength: 4, Params: params } },
+    { "1\n2\n3\n", LoadOptions{ Num: 4, RowLength: 4, Params: params } },
+    { "1\n2\n300\n", LoadOptions{ Num: 3, RowLength: 4, Params: params } },
+    { "1\n2\n300\n", LoadOptions{ RowLength: 4 } },
+  } {
+    if _, err := LoadLines[matrix.Elem64](strings.NewReader(c.text), c.opts); !errors.Is(err, ErrBadInput) {
+      t.Errorf("%q: expected ErrBadInput, got %v", c.text, err)
+    }
+  }
+
+  if _, err := LoadCSV[matrix.Elem64](strings.NewReader("1,\"2\n"), LoadOptions{}); !errors.Is(err, ErrBadInput) {
+    t.Errorf("Expected ErrBadInput, got %v", err)
+  }
+  if _, err := LoadBinary[matrix.Elem64](bytes.NewReader(make([]byte, 7)), 2, LoadOptions{}); !errors.Is(err, ErrBadInput) {
+    t.Errorf("Expected ErrBadInput, got %v", err)
+  }
+  if _, _, err := LoadRecords[matrix.Elem64](bytes.NewReader(make([]byte, 7)), 5, nil); !errors.Is(err, ErrBadInput) {
+    t.Errorf("Expected ErrBadInput, got %v", err)
+  }
+
+  // Too large or too wide for any LWE parameters
+  opts := LoadOptions{ Num: 1<<50, RowLength: 64 }
+  if _, err := LoadLines[matrix.Elem64](strings.NewReader("1\n"), opts); !errors.Is(err, ErrBadInput) {
+    t.Errorf("Expected ErrBadInput, got %v", err)
+  }
+  if _, _, err := LoadRecords[matrix.Elem64](bytes.NewReader(nil), 1<<40, nil); !errors.Is(err, ErrBadInput) {
+    t.Errorf("Expected ErrBadInput, got %v", err)
+  }
+  if _, err := chooseParams[matrix.Elem32](1<<21, 1<<24); !errors.Is(err, ErrBadInput) {
+    t.Errorf("Expected ErrBadInput, got %v", err)
+  }
+}
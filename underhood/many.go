@@ -0,0 +1,174 @@
+package underhood
+
+import (
+  "sync"
+  "runtime"
+  "sync/atomic"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// LHE queries with k-column messages, which compute db.Data x M for a
+// message matrix M in one round trip.
+//
+// Each message column is encrypted under its own SimplePIR secret: two
+// columns encrypted under the same secret and matrix A would reveal the
+// difference of the messages. So, a token for k columns holds k secrets,
+// and generating it costs k times as much as a single-column token. All
+// k secrets are uploaded in one HintQuery and answered in one HintAnswer,
+// so both also grow k-fold: the upload holds one seeded RLWE ciphertext
+// (about 16 KB) per entry of each secret. cost.Predict, with Secrets set
+// to k, gives the sizes for a given database.
+
+func getColumn[T matrix.Elem](m *matrix.Matrix[T], j uint64) *matrix.Matrix[T] {
+  out := matrix.New[T](m.Rows(), 1)
+  for i := uint64(0); i < m.Rows(); i++ {
+    out.Set(i, 0, m.Get(i, j))
+  }
+  return out
+}
+
+func setColumn[T matrix.Elem](m *matrix.Matrix[T], j uint64, col *matrix.Matrix[T]) {
+  if col.Rows() != m.Rows() || col.Cols() != 1 {
+    panic("Dimension mismatch")
+  }
+  for i := uint64(0); i < m.Rows(); i++ {
+    m.Set(i, j, col.Get(i, 0))
+  }
+}
+
+// Generate a token request for LHE messages with k columns.
+func (c *Client[T]) HintQueryMany(k uint64) *HintQuery {
+  return c.tokens.HintQuery(k)
+}
+
+func (c *Client[T]) PreprocessQueryLHEMany() {
+  k := c.tokens.innerSecret.Cols()
+  c.skLHEMany = make([]*pir.SecretLHE[T], k)
+  for j := uint64(0); j < k; j++ {
+    c.skLHEMany[j] = c.pirClient.PreprocessQueryLHEGivenSecret(getColumn(c.tokens.innerSecret, j))
+  }
+  c.queried = false
+}
+
+// Encrypt the message matrix 'q', which must have as many columns as the token.
+// Returns ErrTokenUsed if the preprocessed secrets were already used.
+func (c *Client[T]) QueryLHEMany(q *matrix.Matrix[T]) (*pir.Query[T], error) {
+  if q.Cols() != uint64(len(c.skLHEMany)) {
+    panic("Message has wrong number of columns")
+  }
+  if err := c.use(); err != nil {
+    return nil, err
+  }
+
+  var out *matrix.Matrix[T]
+  for j, sk := range c.skLHEMany {
+    msg := getColumn(q, uint64(j))
+    col := c.pirClient.QueryLHEPreprocessed(msg, sk).Query
+    if out == nil {
+      out = matrix.Zeros[T](col.Rows(), q.Cols())
+    }
+    setColumn(out, uint64(j), col)
+    c.undoQueryLHE(col, msg)
+  }
+
+  return &pir.Query[T]{ Query: out }, nil
+}
+
+// Rows of the database per block in AnswerMany (a multiple of the 8 rows
+// that SimplePIR's kernel handles at a time).
+const answerRowBlock = 64
+
+// Squish the database as SimplePIR does, in blocks of answerRowBlock rows
+// (the last one padded with zero rows), for AnswerMany.
+func squishBlocks[T matrix.Elem](m *matrix.Matrix[T]) []*matrix.Matrix[T] {
+  var out []*matrix.Matrix[T]
+  cols := m.Cols()
+  for i := uint64(0); i < m.Rows(); i += answerRowBlock {
+    n := m.Rows() - i
+    if n > answerRowBlock {
+      n = answerRowBlock
+    }
+    block := matrix.Zeros[T](answerRowBlock, cols)
+    copy(block.Data(), m.Data()[i*cols : (i+n)*cols])
+    block.Squish()
+    out = append(out, block)
+  }
+  return out
+}
+
+// The blocks of squishBlocks, built on first use: servers that never call
+// AnswerMany do not hold a second copy of the database.
+func (s *Server[T]) squishedBlocks() []*matrix.Matrix[T] {
+  s.blocksOnce.Do(func() {
+    s.blocks = squishBlocks(s.data)
+    s.data = nil
+  })
+  return s.blocks
+}
+
+// Answer a query with one or more columns, i.e., compute db.Data x Q in one
+// pass over the database: each block of rows is multiplied by all of the
+// columns of Q while it is in cache (rather than reading the whole
+// database once per column). The blocks are answered in parallel.
+func (s *Server[T]) AnswerMany(q *pir.Query[T]) (*pir.Answer[T], error) {
+  if err := s.checkQuery(q, MaxSecretsPerQuery); err != nil {
+    return nil, err
+  }
+
+  blocks := s.squishedBlocks()
+  k := q.Query.Cols()
+  cols := make([]*matrix.Matrix[T], k)
+  for j := range cols {
+    cols[j] = getColumn(q.Query, uint64(j))
+  }
+
+  rows := s.pirServer.DBInfo().L
+  out := matrix.New[T](rows, k)
+  workers := runtime.GOMAXPROCS(0)
+  if workers > len(blocks) {
+    workers = len(blocks)
+  }
+
+  var next atomic.Int64
+  var wg sync.WaitGroup
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for {
+        b := uint64(next.Add(1) - 1)
+        if b >= uint64(len(blocks)) {
+          return
+        }
+        r0 := b*answerRowBlock
+        n := rows - r0
+        if n > answerRowBlock {
+          n = answerRowBlock
+        }
+
+        for j, col := range cols {
+          prod := matrix.MulVecPacked(blocks[b], col).Data()
+          for r := uint64(0); r < n; r++ {
+            out.Data()[(r0 + r)*k + uint64(j)] = prod[r]
+          }
+        }
+      }
+    }()
+  }
+  wg.Wait()
+
+  return &pir.Answer[T]{ Answer: out }, nil
+}
+
+// Recover db.Data x M (mod p), where M is the message given to QueryLHEMany.
+func (c *Client[T]) RecoverLHEMany(ansIn *pir.Answer[T]) *matrix.Matrix[T] {
+  ans := ansIn.Answer.Copy()
+  ans.Sub(c.interm)
+
+  out := matrix.Zeros[T](ans.Rows(), ans.Cols())
+  for j := uint64(0); j < ans.Cols(); j++ {
+    setColumn(out, j, c.pirClient.DecodeManyLHE(getColumn(ans, j)))
+  }
+  return out
+}
@@ -0,0 +1,88 @@
+package nn
+
+import (
+  "math"
+  mrand "math/rand"
+)
+
+const kMeansIters = 20
+
+func distance(a, b []float64) float64 {
+  d := 0.0
+  for i := range a {
+    d += (a[i] - b[i]) * (a[i] - b[i])
+  }
+  return d
+}
+
+func nearest(centroids [][]float64, v []float64) int {
+  best := 0
+  bestDist := math.Inf(1)
+  for c, centroid := range centroids {
+    if d := distance(centroid, v); d < bestDist {
+      best = c
+      bestDist = d
+    }
+  }
+  return best
+}
+
+// Cluster 'vecs' into (at most) 'k' clusters with Lloyd's algorithm.
+// Returns the cluster centroids and the indices of the vectors in each cluster.
+func kMeans(vecs [][]float64, k int, seed int64) ([][]float64, [][]uint64) {
+  if k > len(vecs) {
+    k = len(vecs)
+  }
+
+  dim := len(vecs[0])
+  r := mrand.New(mrand.NewSource(seed))
+  centroids := make([][]float64, k)
+  for c, i := range r.Perm(len(vecs))[:k] {
+    centroids[c] = append([]float64{}, vecs[i]...)
+  }
+
+  assign := make([]int, len(vecs))
+  for it := 0; it < kMeansIters; it++ {
+    changed := false
+    for i, v := range vecs {
+      c := nearest(centroids, v)
+      if c != assign[i] || it == 0 {
+        changed = true
+      }
+      assign[i] = c
+    }
+
+    if !changed {
+      break
+    }
+
+    sums := make([][]float64, k)
+    counts := make([]int, k)
+    for c := range sums {
+      sums[c] = make([]float64, dim)
+    }
+    for i, v := range vecs {
+      counts[assign[i]] += 1
+      for j, x := range v {
+        sums[assign[i]][j] += x
+      }
+    }
+
+    // Empty clusters keep their old centroid
+    for c := range centroids {
+      if counts[c] == 0 {
+        continue
+      }
+      for j := range centroids[c] {
+        centroids[c][j] = sums[c][j] / float64(counts[c])
+      }
+    }
+  }
+
+  members := make([][]uint64, k)
+  for i := range vecs {
+    members[assign[i]] = append(members[assign[i]], uint64(i))
+  }
+
+  return centroids, members
+}
@@ -0,0 +1,217 @@
+// Package nn implements private nearest-neighbor search over document
+// embeddings, using Tiptoe's linearly homomorphic encryption scheme.
+//
+// The server clusters the documents and lays out the embeddings of each
+// cluster side-by-side in one matrix: document r of cluster c is stored in
+// row r, columns [c*dim, (c+1)*dim). The client picks the cluster nearest
+// to its query locally, and sends an encryption of its (quantized) query
+// embedding placed in that cluster's block of columns. The server's
+// homomorphic matrix-vector product then computes the inner-product score
+// of the query with every document in the cluster, without learning
+// the query or the cluster.
+package nn
+
+import (
+  "sort"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/underhood"
+)
+
+// Public information about the document corpus, which the client
+// needs to build queries and interpret their results.
+type Index struct {
+  Dim       uint64
+  Centroids [][]float64
+  Clusters  [][]uint64   // Clusters[c][r] is the ID of document r in cluster c
+  Quantizer Quantizer    // applied to the document embeddings
+  DBInfo    *pir.DBInfo
+}
+
+type Result struct {
+  ID    uint64
+  Score int64
+}
+
+type Server[T matrix.Elem] struct {
+  server *underhood.Server[T]
+}
+
+type Client[T matrix.Elem] struct {
+  index   *Index
+  client  *underhood.Client[T]
+  cluster int
+}
+
+// Quantized values are always in the centered range mod p.
+func encode(p uint64, v int64) uint64 {
+  e, err := underhood.EncodeSigned(p, v)
+  if err != nil {
+    panic(err)
+  }
+  return e
+}
+
+func log2(p uint64) uint64 {
+  bits := uint64(0)
+  for (uint64(1) << bits) < p {
+    bits += 1
+  }
+  return bits
+}
+
+// Build the server-side matrix of quantized embeddings. The SimplePIR
+// plaintext modulus 'pMod' must be a power of two.
+//
+// Beware! You must call Free() on the output Server to clean up C++ objects.
+func NewServer[T matrix.Elem](docs [][]float64, numClusters int, pMod uint64, seed *rand.PRGKey) (*Server[T], *Index) {
+  if len(docs) == 0 {
+    panic("Empty corpus!")
+  }
+
+  if (pMod & (pMod - 1)) != 0 {
+    panic("Plaintext modulus must be a power of two")
+  }
+
+  dim := uint64(len(docs[0]))
+  for _, d := range docs {
+    if uint64(len(d)) != dim {
+      panic("Embeddings have different dimensions")
+    }
+  }
+
+  bound := maxBound(dim, pMod)
+  if bound == 0 {
+    panic("Plaintext modulus is too small for this embedding dimension")
+  }
+
+  centroids, clusters := kMeans(docs, numClusters, 0)
+  quant := newQuantizer(docs, bound)
+
+  rows := uint64(0)
+  for _, members := range clusters {
+    if uint64(len(members)) > rows {
+      rows = uint64(len(members))
+    }
+  }
+
+  cols := uint64(len(clusters)) * dim
+  params := lwe.NewParamsFixedP(T(0).Bitlen(), cols, pMod)
+  if params == nil {
+    panic("Could not find LWE Params")
+  }
+
+  vals := make([]uint64, rows * cols)
+  for c, members := range clusters {
+    for r, id := range members {
+      for j, x := range docs[id] {
+        vals[uint64(r)*cols + uint64(c)*dim + uint64(j)] = encode(pMod, quant.Quantize(x))
+      }
+    }
+  }
+
+  db := pir.NewDatabaseFixedParams[T](rows * cols, log2(pMod), vals, params)
+
+  index := &Index{
+    Dim: dim,
+    Centroids: centroids,
+    Clusters: clusters,
+    Quantizer: quant,
+    DBInfo: db.Info,
+  }
+
+  return &Server[T]{
+    server: underhood.NewServer(db, seed),
+  }, index
+}
+
+func (s *Server[T]) Free() {
+  s.server.Free()
+}
+
+func (s *Server[T]) HintAnswer(q *underhood.HintQuery) (*underhood.HintAnswer, error) {
+  return s.server.HintAnswer(q)
+}
+
+func (s *Server[T]) Answer(q *pir.Query[T]) (*pir.Answer[T], error) {
+  return s.server.Answer(q)
+}
+
+// WARNING: You must call Free() on this client to cleanup
+func NewClient[T matrix.Elem](seed *rand.PRGKey, index *Index) *Client[T] {
+  return &Client[T]{
+    index: index,
+    client: underhood.NewClient[T](seed, index.DBInfo),
+  }
+}
+
+func (c *Client[T]) Free() {
+  c.client.Free()
+}
+
+func (c *Client[T]) HintQuery() *underhood.HintQuery {
+  return c.client.HintQuery()
+}
+
+func (c *Client[T]) HintRecover(ans *underhood.HintAnswer) error {
+  return c.client.HintRecover(ans)
+}
+
+func (c *Client[T]) PreprocessQuery() {
+  c.client.PreprocessQueryLHE()
+}
+
+// Build an encrypted query for the documents nearest to 'emb'.
+// Returns underhood.ErrTokenUsed if the token was already used.
+func (c *Client[T]) Query(emb []float64) (*pir.Query[T], error) {
+  if uint64(len(emb)) != c.index.Dim {
+    panic("Query has wrong dimension")
+  }
+
+  p := c.index.DBInfo.P()
+  dim := c.index.Dim
+  cluster := nearest(c.index.Centroids, emb)
+
+  // The query is quantized with its own scale: this scales all of the
+  // scores by the same factor, so does not change their ranking.
+  quant := newQuantizer([][]float64{emb}, c.index.Quantizer.Bound)
+
+  msg := matrix.Zeros[T](c.index.DBInfo.M, 1)
+  for j, x := range emb {
+    msg.Set(uint64(cluster)*dim + uint64(j), 0, T(encode(p, quant.Quantize(x))))
+  }
+
+  q, err := c.client.QueryLHE(msg)
+  if err != nil {
+    return nil, err
+  }
+  c.cluster = cluster
+  return q, nil
+}
+
+// Recover the (at most) 'k' highest-scoring documents, in decreasing
+// order of score.
+func (c *Client[T]) Recover(ans *pir.Answer[T], k int) []Result {
+  p := c.index.DBInfo.P()
+  scores := c.client.RecoverLHE(ans)
+  members := c.index.Clusters[c.cluster]
+
+  out := make([]Result, len(members))
+  for r, id := range members {
+    out[r] = Result{
+      ID: id,
+      Score: underhood.DecodeSigned(p, uint64(scores.Get(uint64(r), 0))),
+    }
+  }
+
+  sort.SliceStable(out, func(i, j int) bool {
+    return out[i].Score > out[j].Score
+  })
+
+  if k < len(out) {
+    out = out[:k]
+  }
+  return out
+}
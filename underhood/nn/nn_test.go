@@ -0,0 +1,129 @@
+package nn
+
+import (
+  "sort"
+  "testing"
+  mrand "math/rand"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/underhood"
+)
+
+func randEmbeddings(num, dim int, seed int64) [][]float64 {
+  r := mrand.New(mrand.NewSource(seed))
+  out := make([][]float64, num)
+  for i := range out {
+    out[i] = make([]float64, dim)
+    for j := range out[i] {
+      out[i][j] = r.NormFloat64()
+    }
+  }
+  return out
+}
+
+func TestQuantizer(t *testing.T) {
+  p := uint64(1 << 17)
+  dim := uint64(64)
+  b := maxBound(dim, p)
+  if b <= 0 || uint64(b*b)*dim >= p/2 || uint64((b+1)*(b+1))*dim < p/2 {
+    t.Fatalf("Bad bound %v", b)
+  }
+
+  vecs := randEmbeddings(10, int(dim), 1)
+  q := newQuantizer(vecs, b)
+  for _, v := range vecs {
+    for _, x := range v {
+      y := q.Quantize(x)
+      if y > b || y < -b {
+        t.Fatalf("%v out of range", y)
+      }
+      if underhood.DecodeSigned(p, encode(p, y)) != y {
+        t.Fatalf("%v does not round-trip", y)
+      }
+    }
+  }
+}
+
+func TestKMeans(t *testing.T) {
+  vecs := randEmbeddings(500, 8, 2)
+  centroids, clusters := kMeans(vecs, 10, 0)
+
+  seen := make(map[uint64]bool)
+  for c, members := range clusters {
+    for _, id := range members {
+      if seen[id] || nearest(centroids, vecs[id]) != c {
+        t.Fatalf("Bad assignment of %v", id)
+      }
+      seen[id] = true
+    }
+  }
+
+  if len(seen) != len(vecs) {
+    t.Fail()
+  }
+}
+
+func testSearch[IntT matrix.Elem](t *testing.T, num, dim, clusters int, pMod uint64) {
+  docs := randEmbeddings(num, dim, 3)
+  seed := rand.RandomPRGKey() // matrix A seed
+
+  server, index := NewServer[IntT](docs, clusters, pMod, seed)
+  defer server.Free()
+
+  client := NewClient[IntT](seed, index)
+  defer client.Free()
+
+  // Token-generation phase
+  hq := client.HintQuery()
+  hans, err := server.HintAnswer(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  // Query phase
+  emb := randEmbeddings(1, dim, 4)[0]
+  q, err := client.Query(emb)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  res := client.Recover(ans, 10)
+
+  // Compute the expected scores in the clear
+  qq := newQuantizer([][]float64{emb}, index.Quantizer.Bound)
+  members := index.Clusters[nearest(index.Centroids, emb)]
+  expected := make([]Result, len(members))
+  for r, id := range members {
+    expected[r].ID = id
+    for j := range emb {
+      expected[r].Score += qq.Quantize(emb[j]) * index.Quantizer.Quantize(docs[id][j])
+    }
+  }
+  sort.SliceStable(expected, func(i, j int) bool {
+    return expected[i].Score > expected[j].Score
+  })
+
+  if len(res) != 10 {
+    t.Fatalf("Expected 10 results, got %v", len(res))
+  }
+  for i := range res {
+    if res[i] != expected[i] {
+      t.Errorf("[%v] %v vs. %v", i, res[i], expected[i])
+    }
+  }
+}
+
+func TestSearch64(t *testing.T) {
+  testSearch[matrix.Elem64](t, 1<<12, 32, 16, 1<<17)
+}
+
+func TestSearch32(t *testing.T) {
+  testSearch[matrix.Elem32](t, 1<<12, 16, 16, 1<<8)
+}
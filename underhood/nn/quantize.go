@@ -0,0 +1,53 @@
+package nn
+
+import (
+  "math"
+)
+
+// Maps real-valued embeddings to small signed integers in [-Bound, Bound],
+// which are then represented mod p.
+type Quantizer struct {
+  Scale float64
+  Bound int64
+}
+
+// Largest bound B such that the inner product of two length-'dim' vectors
+// with entries in [-B, B] always lies in (-p/2, p/2), so it can be decoded
+// from its value mod p.
+func maxBound(dim, p uint64) int64 {
+  b := int64(math.Sqrt(float64(p/2 - 1) / float64(dim)))
+  for b > 0 && uint64(b*b)*dim >= p/2 {
+    b -= 1
+  }
+  return b
+}
+
+// Build a quantizer that maps the largest-magnitude entry of 'vecs' to 'bound'.
+func newQuantizer(vecs [][]float64, bound int64) Quantizer {
+  maxAbs := 0.0
+  for _, v := range vecs {
+    for _, x := range v {
+      maxAbs = math.Max(maxAbs, math.Abs(x))
+    }
+  }
+
+  if maxAbs == 0 {
+    maxAbs = 1
+  }
+
+  return Quantizer{
+    Scale: float64(bound) / maxAbs,
+    Bound: bound,
+  }
+}
+
+func (q Quantizer) Quantize(x float64) int64 {
+  v := int64(math.Round(x * q.Scale))
+  if v > q.Bound {
+    return q.Bound
+  }
+  if v < -q.Bound {
+    return -q.Bound
+  }
+  return v
+}
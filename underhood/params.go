@@ -24,6 +24,13 @@ func newParams() *params {
   }
 }
 
+// A context whose randomness derives from 'seed' (for tests only).
+func newParamsSeeded(seed *rlwe.Seed) *params {
+  return &params{
+    ctx: rlwe.NewContextSeeded(seed),
+  }
+}
+
 // Must call to clean up memory
 func (p *params) Free() {
   p.ctx.Free()
@@ -23,14 +23,25 @@ func testPIR[IntT matrix.Elem](t *testing.T, dbSize uint64) {
 
   // Token-generation phase
   hq := client.HintQuery()
-  hans := server.HintAnswer(hq)
-  client.HintRecover(hans)
+  hans, err := server.HintAnswer(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
   client.PreprocessQuery()
 
   // Query phase
   idx := uint64(7)
-  q := client.Query(idx)
-  ans := server.Answer(q)
+  q, err := client.Query(idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
   msg := client.Recover(ans)
 
   for row := 0; row < len(msg); row++ {
@@ -72,3 +83,49 @@ func TestPIRBig32(t *testing.T) {
 func TestPIRHuge32(t *testing.T) {
   testPIR[matrix.Elem32](t, 1<<24)
 }
+
+func TestPIRReuse(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<10, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  client := NewClient[matrix.Elem64](seed, db.Info)
+  defer client.Free()
+
+  hans, err := server.HintAnswer(client.HintQuery())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  if _, err := client.Query(3); err != nil {
+    t.Fatal(err)
+  }
+
+  // A second query under the same secret is refused...
+  if _, err := client.Query(5); err != ErrTokenUsed {
+    t.Fatalf("Expected ErrTokenUsed, got %v", err)
+  }
+
+  // ... unless in unsafe mode, where each query is still correct.
+  client.AllowUnsafeReuse()
+  for _, idx := range []uint64{5, 9} {
+    q, err := client.Query(idx)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if client.Recover(ans)[0] != db.GetElem(idx) {
+      t.Fail()
+    }
+  }
+}
@@ -0,0 +1,175 @@
+package underhood
+
+import (
+  "time"
+  "errors"
+  "sync"
+  "context"
+  "sync/atomic"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+)
+
+// A TokenPool keeps several tokens ready to use, so that fetching a token
+// (HintQuery, HintAnswer, HintRecover and PreprocessQuery) is off the
+// critical path of a query. A background goroutine refills the pool
+// whenever a token is taken out of it.
+
+var ErrPoolClosed = errors.New("underhood: token pool is closed")
+
+// Transport carries token requests to the server (e.g., over the network).
+// *Server implements it directly. An implementation should time out on its
+// own: TokenPool and Proxy do not cancel a request once it is sent.
+type Transport interface {
+  HintAnswer(q *HintQuery) (*HintAnswer, error)
+}
+
+type PoolConfig struct {
+  Size       int           // number of tokens to keep ready
+  LHE        bool          // preprocess tokens for QueryLHE (instead of Query)
+  RetryDelay time.Duration // wait after a failed refill
+}
+
+type PoolStats struct {
+  Depth     int    // tokens ready to use
+  Generated uint64 // tokens fetched from the server
+  Taken     uint64 // tokens handed out by Get
+  Waits     uint64 // calls to Get that found the pool empty
+  Failures  uint64 // failed refills
+}
+
+type TokenPool[T matrix.Elem] struct {
+  cfg       PoolConfig
+  client    *Client[T] // used only by the refill goroutine
+  transport Transport
+
+  ready     chan *Token[T]
+  slots     chan struct{} // one per token that must be fetched
+  stop      chan struct{}
+  closeOnce sync.Once
+
+  generated atomic.Uint64
+  taken     atomic.Uint64
+  waits     atomic.Uint64
+  failures  atomic.Uint64
+}
+
+// Beware! You must call Close() on the output TokenPool to clean up C++ objects.
+func NewTokenPool[T matrix.Elem](matrixAseed *rand.PRGKey, dbinfo *pir.DBInfo, transport Transport, cfg PoolConfig) *TokenPool[T] {
+  if cfg.Size <= 0 {
+    panic("Pool must hold at least one token")
+  }
+  if cfg.RetryDelay == 0 {
+    cfg.RetryDelay = time.Second
+  }
+
+  p := &TokenPool[T]{
+    cfg: cfg,
+    client: NewClient[T](matrixAseed, dbinfo),
+    transport: transport,
+    ready: make(chan *Token[T], cfg.Size),
+    slots: make(chan struct{}, cfg.Size),
+    stop: make(chan struct{}),
+  }
+
+  for i := 0; i < cfg.Size; i++ {
+    p.slots <- struct{}{}
+  }
+
+  go p.refill()
+  return p
+}
+
+// Stop refilling the pool. Tokens already taken from the pool remain
+// usable. Close does not wait for a token request in flight: the refill
+// goroutine cleans up once the transport returns. Calls after the first
+// do nothing.
+func (p *TokenPool[T]) Close() {
+  p.closeOnce.Do(func() {
+    close(p.stop)
+  })
+}
+
+func (p *TokenPool[T]) fetch() (*Token[T], error) {
+  ans, err := p.transport.HintAnswer(p.client.HintQuery())
+  if err != nil {
+    return nil, err
+  }
+  if err := p.client.HintRecover(ans); err != nil {
+    return nil, err
+  }
+
+  if p.cfg.LHE {
+    p.client.PreprocessQueryLHE()
+  } else {
+    p.client.PreprocessQuery()
+  }
+  return p.client.TakeToken(), nil
+}
+
+func (p *TokenPool[T]) refill() {
+  defer p.client.Free()
+
+  for {
+    select {
+    case <-p.stop:
+      return
+    case <-p.slots:
+    }
+    // Both may be ready: stop wins
+    select {
+    case <-p.stop:
+      return
+    default:
+    }
+
+    tok, err := p.fetch()
+    if err != nil {
+      p.failures.Add(1)
+      p.slots <- struct{}{}
+
+      select {
+      case <-p.stop:
+        return
+      case <-time.After(p.cfg.RetryDelay):
+      }
+      continue
+    }
+
+    p.generated.Add(1)
+    p.ready <- tok // never blocks: there are only cfg.Size slots
+  }
+}
+
+// Take a token out of the pool, waiting for one if the pool is empty.
+func (p *TokenPool[T]) Get(ctx context.Context) (*Token[T], error) {
+  var tok *Token[T]
+
+  select {
+  case tok = <-p.ready:
+  default:
+    p.waits.Add(1)
+    select {
+    case tok = <-p.ready:
+    case <-p.stop:
+      return nil, ErrPoolClosed
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+
+  p.taken.Add(1)
+  p.slots <- struct{}{}
+  return tok, nil
+}
+
+func (p *TokenPool[T]) Stats() PoolStats {
+  return PoolStats{
+    Depth: len(p.ready),
+    Generated: p.generated.Load(),
+    Taken: p.taken.Load(),
+    Waits: p.waits.Load(),
+    Failures: p.failures.Load(),
+  }
+}
@@ -0,0 +1,181 @@
+package underhood
+
+import (
+  "time"
+  "errors"
+  "context"
+  "testing"
+  "sync/atomic"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+var errTransport = errors.New("transport failed")
+
+// A transport whose first 'fail' requests fail.
+type flakyTransport struct {
+  server *Server[matrix.Elem64]
+  fail   int64
+  calls  atomic.Int64
+}
+
+func (f *flakyTransport) HintAnswer(q *HintQuery) (*HintAnswer, error) {
+  if f.calls.Add(1) <= f.fail {
+    return nil, errTransport
+  }
+  return f.server.HintAnswer(q)
+}
+
+// A transport whose requests hang until 'release' is closed.
+type hangingTransport struct {
+  started chan struct{}
+  release chan struct{}
+}
+
+func newHangingTransport() *hangingTransport {
+  return &hangingTransport{ started: make(chan struct{}, 16), release: make(chan struct{}) }
+}
+
+func (h *hangingTransport) HintAnswer(q *HintQuery) (*HintAnswer, error) {
+  h.started <- struct{}{}
+  <-h.release
+  return nil, errTransport
+}
+
+// Run f, and fail if it does not return within a second.
+func returnsPromptly(t *testing.T, what string, f func()) {
+  done := make(chan struct{})
+  go func() {
+    f()
+    close(done)
+  }()
+  select {
+  case <-done:
+  case <-time.After(time.Second):
+    t.Fatalf("%s blocked", what)
+  }
+}
+
+func waitForDepth[T matrix.Elem](t *testing.T, pool *TokenPool[T], depth int) {
+  deadline := time.Now().Add(time.Minute)
+  for pool.Stats().Depth < depth {
+    if time.Now().After(deadline) {
+      t.Fatalf("Pool did not fill up: %+v", pool.Stats())
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestTokenPool(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  transport := &flakyTransport{ server: server, fail: 2 }
+  pool := NewTokenPool[matrix.Elem64](seed, db.Info, transport, PoolConfig{
+    Size: 3,
+    RetryDelay: time.Millisecond,
+  })
+  defer pool.Close()
+
+  waitForDepth(t, pool, 3)
+  if stats := pool.Stats(); stats.Failures != 2 || stats.Generated != 3 {
+    t.Fatalf("Unexpected stats: %+v", stats)
+  }
+
+  for _, idx := range []uint64{7, 1000, 4000} {
+    tok, err := pool.Get(context.Background())
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    q, err := tok.Query(idx)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    vals := tok.Recover(ans)
+    if db.GetElem(idx) != vals[idx / db.Info.M] {
+      t.Fail()
+    }
+
+    // Each token builds only one query
+    if _, err := tok.Query(idx); err != ErrTokenUsed {
+      t.Fatal("Token was reused")
+    }
+  }
+
+  // The pool refills in the background
+  waitForDepth(t, pool, 3)
+  if stats := pool.Stats(); stats.Taken != 3 || stats.Generated != 6 {
+    t.Fatalf("Unexpected stats: %+v", stats)
+  }
+}
+
+func TestTokenPoolEmpty(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  // The server never answers
+  transport := &flakyTransport{ server: server, fail: 1<<40 }
+  pool := NewTokenPool[matrix.Elem64](seed, db.Info, transport, PoolConfig{
+    Size: 1,
+    RetryDelay: time.Millisecond,
+  })
+
+  ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+  defer cancel()
+  if _, err := pool.Get(ctx); err != context.DeadlineExceeded {
+    t.Fatalf("Expected timeout, got %v", err)
+  }
+
+  // Close does not wait for the refill in flight
+  deadline := time.Now().Add(time.Minute)
+  for pool.Stats().Failures == 0 {
+    if time.Now().After(deadline) {
+      t.Fatal("Refill never failed")
+    }
+    time.Sleep(time.Millisecond)
+  }
+  pool.Close()
+  if _, err := pool.Get(context.Background()); err != ErrPoolClosed {
+    t.Fatalf("Expected ErrPoolClosed, got %v", err)
+  }
+
+  // Closing again does nothing
+  pool.Close()
+
+  if stats := pool.Stats(); stats.Waits != 2 {
+    t.Fatalf("Unexpected stats: %+v", stats)
+  }
+}
+
+// Close does not wait for a request that hangs upstream.
+func TestTokenPoolCloseHanging(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 1, params)
+
+  transport := newHangingTransport()
+  defer close(transport.release)
+  pool := NewTokenPool[matrix.Elem64](seed, db.Info, transport, PoolConfig{ Size: 1 })
+
+  <-transport.started
+  returnsPromptly(t, "Close", pool.Close)
+  if _, err := pool.Get(context.Background()); err != ErrPoolClosed {
+    t.Fatalf("Expected ErrPoolClosed, got %v", err)
+  }
+}
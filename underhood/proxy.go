@@ -0,0 +1,221 @@
+package underhood
+
+import (
+  "io"
+  "sync"
+  "errors"
+  "context"
+  "crypto/rand"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+// A Proxy fetches tokens on behalf of clients that are often offline
+// (e.g., a desktop or an edge box that serves a phone). The server computes
+// a HintAnswer from the encrypted secret alone, so the proxy needs nothing
+// but the client's HintQuery:
+// 1) The client builds PendingTokens, keeps their secrets, and sends only
+//    their queries to the proxy (Submit), which returns one Ticket each.
+// 2) The proxy forwards the queries to the server, and caches the
+//    (encrypted) answers.
+// 3) Later, the client collects each answer with its ticket (Collect), and
+//    recovers the token with RecoverPending.
+//
+// The proxy sees only RLWE ciphertexts, and never the client's queries to
+// the database. (A proxy can also fetch tokens itself, under the client's
+// public key: see Delegate.)
+
+var ErrUnknownTicket = errors.New("underhood: unknown proxy ticket")
+var ErrProxyFull = errors.New("underhood: proxy holds too many requests")
+var ErrProxyClosed = errors.New("underhood: proxy is closed")
+
+// A Ticket names one request held by a proxy. Tickets are random, so that
+// only the client that submitted a request can collect its answer.
+type Ticket [16]byte
+
+type proxyEntry struct {
+  done chan struct{} // closed once ans or err is set
+  ans  *HintAnswer
+  err  error
+}
+
+type Proxy struct {
+  upstream   Transport
+  maxPending int
+  sem        chan struct{} // bounds the requests in flight upstream
+
+  mu         sync.Mutex
+  entries    map[Ticket]*proxyEntry
+  closed     bool
+  stop       chan struct{} // closed by Close
+}
+
+// Output a proxy that forwards requests to 'upstream' (e.g., a Server, or
+// a network connection to one), with at most 'parallelism' requests in
+// flight at once, and that holds at most 'maxPending' requests (answered
+// or not) until their clients collect them.
+func NewProxy(upstream Transport, parallelism, maxPending int) *Proxy {
+  if parallelism <= 0 || maxPending <= 0 {
+    panic("Proxy must hold at least one request")
+  }
+
+  return &Proxy{
+    upstream: upstream,
+    maxPending: maxPending,
+    sem: make(chan struct{}, parallelism),
+    entries: make(map[Ticket]*proxyEntry),
+    stop: make(chan struct{}),
+  }
+}
+
+func newTicket() Ticket {
+  var t Ticket
+  if _, err := io.ReadFull(rand.Reader, t[:]); err != nil {
+    panic(err)
+  }
+  return t
+}
+
+// Accept the hint queries, and forward them upstream in the background.
+// Returns one ticket per query, or ErrProxyFull (and accepts none of them)
+// if the proxy cannot hold them all.
+func (p *Proxy) Submit(qs ...*HintQuery) ([]Ticket, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.closed {
+    return nil, ErrProxyClosed
+  }
+  if len(p.entries) + len(qs) > p.maxPending {
+    return nil, ErrProxyFull
+  }
+
+  tickets := make([]Ticket, len(qs))
+  for i, q := range qs {
+    e := &proxyEntry{ done: make(chan struct{}) }
+    tickets[i] = newTicket()
+    p.entries[tickets[i]] = e
+
+    go p.forward(q, e)
+  }
+  return tickets, nil
+}
+
+// Requests still waiting for a slot when the proxy closes are not sent.
+func (p *Proxy) forward(q *HintQuery, e *proxyEntry) {
+  defer close(e.done)
+
+  select {
+  case p.sem <- struct{}{}:
+  case <-p.stop:
+    e.err = ErrProxyClosed
+    return
+  }
+  e.ans, e.err = p.upstream.HintAnswer(q)
+  <-p.sem
+}
+
+// Hand out the answer to the request with ticket 't', waiting for it if
+// it is still in flight, and forget the request. Returns the upstream
+// error if the request failed, and ErrUnknownTicket if the proxy does not
+// hold the ticket (e.g., if it was already collected), or ErrProxyClosed
+// once the proxy is closed.
+func (p *Proxy) Collect(ctx context.Context, t Ticket) (*HintAnswer, error) {
+  p.mu.Lock()
+  e, ok := p.entries[t]
+  closed := p.closed
+  p.mu.Unlock()
+  if closed {
+    return nil, ErrProxyClosed
+  }
+  if !ok {
+    return nil, ErrUnknownTicket
+  }
+
+  select {
+  case <-e.done:
+  case <-p.stop:
+    return nil, ErrProxyClosed
+  case <-ctx.Done():
+    return nil, ctx.Err()
+  }
+
+  // Another Collect of the same ticket may have raced us here
+  p.mu.Lock()
+  _, ok = p.entries[t]
+  delete(p.entries, t)
+  p.mu.Unlock()
+  if !ok {
+    return nil, ErrUnknownTicket
+  }
+
+  return e.ans, e.err
+}
+
+// Number of requests that the proxy holds (answered or not).
+func (p *Proxy) Pending() int {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return len(p.entries)
+}
+
+// Stop accepting requests, and drop all answers. Close does not wait for
+// the requests in flight upstream: their answers are dropped when they
+// arrive. Calls after the first do nothing.
+func (p *Proxy) Close() {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.closed {
+    return
+  }
+  p.closed = true
+  close(p.stop)
+  p.entries = make(map[Ticket]*proxyEntry)
+}
+
+// A token request whose answer the client collects later (e.g., from a
+// Proxy). Only Query leaves the client: the rest is the client's secret
+// state for this request.
+type PendingToken[T matrix.Elem] struct {
+  Query       *HintQuery
+
+  innerSecret *matrix.Matrix[T]
+  outerSeed   *rlwe.Seed
+}
+
+// Build a token request, to recover later with RecoverPending. The client
+// can build several before it recovers any, and its current token stays
+// as is.
+func (c *Client[T]) NewPendingToken() *PendingToken[T] {
+  secret, seed, q := c.tokens.newHintQuery(1)
+  return &PendingToken[T]{
+    Query: q,
+    innerSecret: secret,
+    outerSeed: seed,
+  }
+}
+
+// Recover H.s for the pending request, from the server's answer to its
+// query. The client can then call PreprocessQuery (or PreprocessQueryLHE),
+// as after HintRecover. Returns ErrTokenUsed if the request was already
+// recovered, and an error wrapping ErrBadHintAnswer on a malformed answer
+// (which leaves the client's current token as is).
+func (c *Client[T]) RecoverPending(p *PendingToken[T], ans *HintAnswer) error {
+  if p.innerSecret == nil {
+    return ErrTokenUsed
+  }
+
+  oldSecret, oldSeed := c.tokens.innerSecret, c.tokens.outerSeed
+  c.tokens.innerSecret = p.innerSecret
+  c.tokens.outerSeed = p.outerSeed
+  if err := c.HintRecover(ans); err != nil {
+    c.tokens.innerSecret, c.tokens.outerSeed = oldSecret, oldSeed
+    return err
+  }
+
+  // Each secret builds at most one query
+  p.innerSecret = nil
+  p.outerSeed = nil
+  return nil
+}
@@ -0,0 +1,216 @@
+package underhood
+
+import (
+  "time"
+  "errors"
+  "context"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// A transport that answers each query with its length.
+type echoTransport struct {
+  fail  bool
+  delay time.Duration
+}
+
+func (e *echoTransport) HintAnswer(q *HintQuery) (*HintAnswer, error) {
+  time.Sleep(e.delay)
+  if e.fail {
+    return nil, errTransport
+  }
+  return &HintAnswer{ MatrixRows: uint64(len(*q)) }, nil
+}
+
+func TestProxyTickets(t *testing.T) {
+  proxy := NewProxy(&echoTransport{ delay: 10*time.Millisecond }, 2, 3)
+  defer proxy.Close()
+
+  qs := make([]*HintQuery, 4)
+  for i := range qs {
+    q := make(HintQuery, i+1)
+    qs[i] = &q
+  }
+
+  if _, err := proxy.Submit(qs...); !errors.Is(err, ErrProxyFull) {
+    t.Fatalf("Got %v, want ErrProxyFull", err)
+  }
+
+  tickets, err := proxy.Submit(qs[:3]...)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if proxy.Pending() != 3 {
+    t.Fatalf("Proxy holds %d requests, want 3", proxy.Pending())
+  }
+
+  // Collect out of order
+  ctx := context.Background()
+  for _, i := range []int{ 2, 0, 1 } {
+    ans, err := proxy.Collect(ctx, tickets[i])
+    if err != nil {
+      t.Fatal(err)
+    }
+    if ans.MatrixRows != uint64(i+1) {
+      t.Fatalf("Ticket %d got the answer to query %d", i, ans.MatrixRows-1)
+    }
+  }
+
+  if _, err := proxy.Collect(ctx, tickets[0]); !errors.Is(err, ErrUnknownTicket) {
+    t.Fatalf("Got %v, want ErrUnknownTicket", err)
+  }
+  if _, err := proxy.Collect(ctx, Ticket{}); !errors.Is(err, ErrUnknownTicket) {
+    t.Fatalf("Got %v, want ErrUnknownTicket", err)
+  }
+  if proxy.Pending() != 0 {
+    t.Fatalf("Proxy holds %d requests, want 0", proxy.Pending())
+  }
+}
+
+func TestProxyErrors(t *testing.T) {
+  upstream := &echoTransport{ fail: true, delay: time.Second }
+  proxy := NewProxy(upstream, 1, 1)
+
+  q := make(HintQuery, 1)
+  tickets, err := proxy.Submit(&q)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // The answer is not ready yet
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+  if _, err := proxy.Collect(ctx, tickets[0]); !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("Got %v, want context.DeadlineExceeded", err)
+  }
+
+  // The upstream error reaches the client
+  if _, err := proxy.Collect(context.Background(), tickets[0]); !errors.Is(err, errTransport) {
+    t.Fatalf("Got %v, want errTransport", err)
+  }
+
+  proxy.Close()
+  if _, err := proxy.Submit(&q); !errors.Is(err, ErrProxyClosed) {
+    t.Fatalf("Got %v, want ErrProxyClosed", err)
+  }
+}
+
+// Close does not wait for requests that hang upstream, and a Collect
+// waiting on one of them returns.
+func TestProxyCloseHanging(t *testing.T) {
+  upstream := newHangingTransport()
+  defer close(upstream.release)
+  proxy := NewProxy(upstream, 1, 2)
+
+  q := make(HintQuery, 1)
+  tickets, err := proxy.Submit(&q, &q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  <-upstream.started
+
+  collected := make(chan error)
+  go func() {
+    _, err := proxy.Collect(context.Background(), tickets[0])
+    collected <- err
+  }()
+
+  returnsPromptly(t, "Close", proxy.Close)
+  if err := <-collected; !errors.Is(err, ErrProxyClosed) {
+    t.Fatalf("Got %v, want ErrProxyClosed", err)
+  }
+  proxy.Close()
+}
+
+// The client builds its requests while online, and collects the answers
+// from the proxy later. The proxy is built from the server alone.
+func testProxyLoopback[IntT matrix.Elem](t *testing.T) {
+  seed := rand.RandomPRGKey()
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[IntT](rand.NewRandomBufPRG(), 1<<12, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  client := NewClient[IntT](seed, db.Info)
+  defer client.Free()
+
+  proxy := NewProxy(server, 1, 8)
+  defer proxy.Close()
+
+  // A current token, fetched directly
+  hans, err := server.HintAnswer(client.HintQuery())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+
+  const num = 3
+  pending := make([]*PendingToken[IntT], num)
+  qs := make([]*HintQuery, num)
+  for i := range pending {
+    pending[i] = client.NewPendingToken()
+    qs[i] = pending[i].Query
+  }
+
+  // Building pending requests leaves the current token as is, as does
+  // a malformed answer to one of them
+  if err := client.RecoverPending(pending[0], &HintAnswer{}); !errors.Is(err, ErrBadHintAnswer) {
+    t.Fatalf("Got %v, want ErrBadHintAnswer", err)
+  }
+  client.PreprocessQuery()
+  proxyQuery(t, server, client, db, 5)
+
+  tickets, err := proxy.Submit(qs...)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for i := range pending {
+    ans, err := proxy.Collect(context.Background(), tickets[i])
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err := client.RecoverPending(pending[i], ans); err != nil {
+      t.Fatal(err)
+    }
+    if err := client.RecoverPending(pending[i], ans); !errors.Is(err, ErrTokenUsed) {
+      t.Fatalf("Got %v, want ErrTokenUsed", err)
+    }
+    client.PreprocessQuery()
+    proxyQuery(t, server, client, db, uint64(3*i + 1))
+  }
+}
+
+// Query the column of 'idx' with the client's current token, and check
+// the answer.
+func proxyQuery[IntT matrix.Elem](t *testing.T, server *Server[IntT], client *Client[IntT], db *pir.Database[IntT], idx uint64) {
+  q, err := client.Query(idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  pans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  msg := client.Recover(pans)
+  for row := 0; row < len(msg); row++ {
+    j := uint64(row) * db.Info.M + (idx % db.Info.M)
+    if db.GetElem(j) != msg[row] {
+      t.Fatalf("Query %d, row %d: got %d, want %d", idx, row, msg[row], db.GetElem(j))
+    }
+  }
+}
+
+func TestProxyLoopback64(t *testing.T) {
+  testProxyLoopback[matrix.Elem64](t)
+}
+
+func TestProxyLoopback32(t *testing.T) {
+  testProxyLoopback[matrix.Elem32](t)
+}
@@ -0,0 +1,272 @@
+package underhood
+
+import (
+  "fmt"
+  "errors"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/ahenzinger/underhood/rlwe"
+)
+
+// Public-key mode lets a device that does not hold the client's RLWE key
+// (a "delegate": a trusted party, or another of the user's devices) fetch
+// tokens for the client:
+// 1) The client publishes the public key of a long-term RLWE key.
+// 2) The delegate samples fresh SimplePIR secrets, encrypts them under the
+//    public key (Delegate.HintQuery), and forgets them.
+// 3) The server answers with HintAnswerPublic, as for any hint query.
+// 4) The client gets both the hint query and the answer, and decrypts the
+//    secrets from the first and H x s from the second (RecoverDelegated).
+//
+// The delegate must be trusted: it picks the secrets, and sees them. A
+// delegate that keeps them can strip the client's queries down to the
+// queried index; one that picks s = 0 makes the queries reveal the index
+// to the server. RecoverDelegated checks only that each secret value is in
+// range, which catches neither. (The delegate never learns H x s.)
+//
+// Public-key ciphertexts are noisier than symmetric ones, so public-key
+// mode runs under its own BFV context (see rlwe.NewContextPublic), and the
+// server decomposes its hint once more for it. A public-key hint query is
+// also larger: each ciphertext holds two full polynomials (rather than one
+// and a seed), under a ring of twice the dimension, i.e., about 4x the size
+// of a symmetric one.
+
+var ErrBadDelegatedQuery = errors.New("underhood: malformed delegated hint query")
+
+// Beware! You must call Free() on this output params.
+func newParamsPublic() *params {
+  return &params{
+    ctx: rlwe.NewContextPublic(),
+  }
+}
+
+// Also answer hint queries under the public-key context, with
+// HintAnswerPublic. Call this before the server serves requests. Returns
+// an error wrapping ErrInsecure if the public-key BFV parameters are below
+// the threshold set by SetMinSecurityBits.
+func (s *Server[T]) EnablePublicKeyMode() error {
+  if err := checkPublicSecurity(); err != nil {
+    return err
+  }
+
+  if s.publicTokens == nil {
+    s.publicTokens = newTokenServer[T](newParamsPublic(), s.inner)
+    s.publicTokens.ownsParams = true
+  }
+  return nil
+}
+
+// Answer a hint query from a delegate (or from a client in public-key mode).
+func (s *Server[T]) HintAnswerPublic(q *HintQuery) (*HintAnswer, error) {
+  if s.publicTokens == nil {
+    return nil, fmt.Errorf("%w: public-key mode is not enabled", ErrBadHintQuery)
+  }
+  return s.publicTokens.HintAnswer(q)
+}
+
+// Output a client whose RLWE key is long-term, so that it can publish the
+// matching public key for delegates. Its own hint queries (HintQuery) are
+// also under the public-key context: the server answers them with
+// HintAnswerPublic.
+//
+// WARNING: You must call Free() on this client to cleanup
+// Panics if the parameters are below the threshold set by SetMinSecurityBits.
+func NewClientPublicKey[T matrix.Elem](matrixAseed *rand.PRGKey, dbinfo *pir.DBInfo) *Client[T] {
+  mustBeSecure(dbinfo.Params)
+  if err := checkPublicSecurity(); err != nil {
+    panic(err)
+  }
+
+  pirClient := pir.NewClient[T](nil, matrixAseed, dbinfo)
+  return &Client[T]{
+    tokens: &TokenClient[T]{
+      params: newParamsPublic(),
+      inner: simplePIRClient[T]{ Client: pirClient },
+      outerSeed: rlwe.NewSeed(),
+      fixedKey: true,
+    },
+    pirClient: pirClient,
+    delta: dbinfo.Params.Delta,
+    seeds: []rand.PRGKey{ *matrixAseed },
+  }
+}
+
+// The serialized public key, for delegates (see NewDelegate).
+func (c *Client[T]) PublicKey() KeyBlob {
+  return c.tokens.PublicKey()
+}
+
+// Recover the secret from a delegate's hint query, and H x s from the
+// server's answer to it. The client can then call PreprocessQuery (or
+// PreprocessQueryLHE), as after HintRecover. Returns an error wrapping
+// ErrBadDelegatedQuery or ErrBadHintAnswer on malformed input.
+func (c *Client[T]) RecoverDelegated(q *HintQuery, ans *HintAnswer) error {
+  interm, err := c.tokens.RecoverDelegated(q, ans)
+  if err != nil {
+    return err
+  }
+
+  if dim := c.tokens.innerSecret.Rows(); dim != c.SecretDim() {
+    c.tokens.innerSecret = nil
+    return fmt.Errorf("%w: got secrets of dimension %d, want %d",
+                      ErrBadDelegatedQuery, dim, c.SecretDim())
+  }
+
+  c.interm = interm
+  return nil
+}
+
+func (c *TokenClient[T]) PublicKey() KeyBlob {
+  if !c.fixedKey {
+    panic("Client is not in public-key mode")
+  }
+
+  sk := c.params.ctx.NewKeyFromSeed(c.outerSeed)
+  defer sk.Free()
+
+  pk := sk.PublicKey(c.params.ctx)
+  defer pk.Free()
+  return pk.Store()
+}
+
+// Recover the secrets from a delegate's hint query, and H x s (with one
+// column per secret) from the server's answer to it.
+func (c *TokenClient[T]) RecoverDelegated(q *HintQuery, ans *HintAnswer) (*matrix.Matrix[T], error) {
+  if !c.fixedKey {
+    panic("Client is not in public-key mode")
+  }
+  if ans == nil {
+    return nil, fmt.Errorf("%w: missing", ErrBadHintAnswer)
+  }
+
+  // The answer holds HintLimbs ciphertext lists per secret
+  limbs := c.inner.HintLimbs()
+  if len(ans.HintCts) == 0 || len(ans.HintCts) % limbs != 0 {
+    return nil, fmt.Errorf("%w: got %d limbs, want a multiple of %d",
+                           ErrBadHintAnswer, len(ans.HintCts), limbs)
+  }
+
+  secret, err := c.decryptSecret(q, uint64(len(ans.HintCts) / limbs))
+  if err != nil {
+    return nil, err
+  }
+
+  c.innerSecret = secret
+  out, err := c.recoverAS(ans)
+  if err != nil {
+    c.innerSecret = nil
+    return nil, err
+  }
+  return out, nil
+}
+
+// Decrypt the 'k' secrets in a hint query, laid out as in encryptSecret.
+func (c *TokenClient[T]) decryptSecret(q *HintQuery, k uint64) (*matrix.Matrix[T], error) {
+  if q == nil || len(*q) == 0 || uint64(len(*q)) % k != 0 {
+    return nil, fmt.Errorf("%w: wrong number of encrypted secret values for %d secrets",
+                           ErrBadDelegatedQuery, k)
+  }
+
+  sk := c.params.ctx.NewKeyFromSeed(c.outerSeed)
+  defer sk.Free()
+
+  ct := rlwe.NewCiphertext()
+  defer ct.Free()
+
+  pt := rlwe.NewPlaintext()
+  defer pt.Free()
+
+  vals := make([]uint64, c.params.ctx.N())
+  rows := uint64(len(*q)) / k
+  out := matrix.Zeros[T](rows, k)
+
+  for j := uint64(0); j < k; j++ {
+    for i := uint64(0); i < rows; i++ {
+      if err := ct.Load(c.params.ctx, (*q)[j*rows + i]); err != nil {
+        return nil, fmt.Errorf("%w: encrypted secret value %d: %v", ErrBadDelegatedQuery, j*rows + i, err)
+      }
+      if err := sk.Decrypt(ct, pt); err != nil {
+        return nil, fmt.Errorf("%w: encrypted secret value %d: %v", ErrBadDelegatedQuery, j*rows + i, err)
+      }
+
+      // Each ciphertext encrypts one secret value, in the constant term
+      pt.Dump(vals)
+      for _, v := range vals[1:] {
+        if v != 0 {
+          return nil, fmt.Errorf("%w: encrypted secret value %d is not a constant",
+                                 ErrBadDelegatedQuery, j*rows + i)
+        }
+      }
+      if !c.inRange(vals[0]) {
+        return nil, fmt.Errorf("%w: encrypted secret value %d is out of range",
+                               ErrBadDelegatedQuery, j*rows + i)
+      }
+      out.Set(i, j, T(vals[0]))
+    }
+  }
+
+  return out, nil
+}
+
+// A delegate fetches tokens for a client in public-key mode, without
+// holding the client's RLWE key. It is not safe to use from several
+// goroutines at once.
+type Delegate[T matrix.Elem] struct {
+  params *params
+  pk     *rlwe.PublicKey
+  dim    uint64 // SimplePIR secret dimension
+  prg    *rand.BufPRGReader
+}
+
+// Output a delegate for the client that published 'pk', to query the
+// database described by 'dbinfo'. Returns an error wrapping
+// rlwe.ErrMalformedKey if 'pk' is malformed.
+//
+// Beware! You must call Free() on the output Delegate to clean up C++ objects.
+func NewDelegate[T matrix.Elem](dbinfo *pir.DBInfo, pk KeyBlob) (*Delegate[T], error) {
+  p := newParamsPublic()
+  key, err := rlwe.LoadPublicKey(p.ctx, pk)
+  if err != nil {
+    p.Free()
+    return nil, err
+  }
+
+  return &Delegate[T]{
+    params: p,
+    pk: key,
+    dim: dbinfo.Params.N,
+    prg: rand.NewRandomBufPRG(),
+  }, nil
+}
+
+func (d *Delegate[T]) Free() {
+  d.pk.Free()
+  d.params.Free()
+}
+
+// Generate a hint query for k fresh secrets (one per message column), for
+// server.HintAnswerPublic. The delegate passes the query and the server's
+// answer on to the client (see RecoverDelegated), and keeps no secrets.
+func (d *Delegate[T]) HintQuery(k uint64) *HintQuery {
+  if k == 0 {
+    panic("Need at least one secret")
+  }
+
+  ct := rlwe.NewCiphertext()
+  defer ct.Free()
+
+  vals := make([]uint64, d.params.ctx.N())
+  out := make(HintQuery, 0, k*d.dim)
+
+  for j := uint64(0); j < k; j++ {
+    s := matrix.Ternary[T](d.prg, d.dim, 1)
+    for i := uint64(0); i < d.dim; i++ {
+      vals[0] = uint64(s.Get(i, 0)) // Warning: works because secret can't be negative!
+      d.pk.EncryptPublicSlice(d.params.ctx, vals, ct)
+      out = append(out, ct.Store())
+    }
+  }
+
+  return &out
+}
@@ -0,0 +1,167 @@
+package underhood
+
+import (
+  "errors"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func testDelegatedPIR[IntT matrix.Elem](t *testing.T, dbSize uint64) {
+  pMod := uint64(512)
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), 1<<10, pMod)
+  db := pir.NewDatabaseRandomFixedParams[IntT](rand.NewRandomBufPRG(), dbSize, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+  if err := server.EnablePublicKeyMode(); err != nil {
+    t.Fatal(err)
+  }
+
+  client := NewClientPublicKey[IntT](seed, db.Info)
+  defer client.Free()
+
+  delegate, err := NewDelegate[IntT](db.Info, client.PublicKey())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer delegate.Free()
+
+  // The delegate fetches the token, and hands it to the client
+  hq := delegate.HintQuery(1)
+  hans, err := server.HintAnswerPublic(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.RecoverDelegated(hq, hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  idx := uint64(7)
+  q, err := client.Query(idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  msg := client.Recover(ans)
+
+  for row := 0; row < len(msg); row++ {
+    i := uint64(row) * db.Info.M + (idx % db.Info.M)
+    if db.GetElem(i) != msg[row] {
+      t.Fatalf("Row %d: got %d, want %d", row, msg[row], db.GetElem(i))
+    }
+  }
+
+  // The client can still fetch its own tokens, under the same key
+  hq = client.HintQuery()
+  hans, err = server.HintAnswerPublic(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  q, err = client.Query(idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err = server.Answer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  msg = client.Recover(ans)
+  for row := 0; row < len(msg); row++ {
+    i := uint64(row) * db.Info.M + (idx % db.Info.M)
+    if db.GetElem(i) != msg[row] {
+      t.Fatalf("Row %d: got %d, want %d", row, msg[row], db.GetElem(i))
+    }
+  }
+}
+
+func TestDelegatedPIRSmall64(t *testing.T) {
+  testDelegatedPIR[matrix.Elem64](t, 1<<10)
+}
+
+func TestDelegatedPIRMed64(t *testing.T) {
+  testDelegatedPIR[matrix.Elem64](t, 1<<16)
+}
+
+func TestDelegatedPIRSmall32(t *testing.T) {
+  testDelegatedPIR[matrix.Elem32](t, 1<<10)
+}
+
+func TestDelegatedPIRMed32(t *testing.T) {
+  testDelegatedPIR[matrix.Elem32](t, 1<<16)
+}
+
+func TestDelegatedMalformed(t *testing.T) {
+  seed := rand.RandomPRGKey()
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<10, 1, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  client := NewClientPublicKey[matrix.Elem64](seed, db.Info)
+  defer client.Free()
+
+  other := NewClientPublicKey[matrix.Elem64](seed, db.Info)
+  defer other.Free()
+
+  if _, err := NewDelegate[matrix.Elem64](db.Info, []byte{ 1, 2, 3 }); err == nil {
+    t.Fatal("Accepted a malformed public key")
+  }
+
+  delegate, err := NewDelegate[matrix.Elem64](db.Info, other.PublicKey())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer delegate.Free()
+
+  // Public-key mode is off
+  hq := delegate.HintQuery(1)
+  if _, err := server.HintAnswerPublic(hq); !errors.Is(err, ErrBadHintQuery) {
+    t.Fatalf("Got %v, want ErrBadHintQuery", err)
+  }
+
+  if err := server.EnablePublicKeyMode(); err != nil {
+    t.Fatal(err)
+  }
+  hans, err := server.HintAnswerPublic(hq)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // A symmetric-mode hint query does not load under the public-key context
+  plain := NewClient[matrix.Elem64](seed, db.Info)
+  defer plain.Free()
+  if _, err := server.HintAnswerPublic(plain.HintQuery()); !errors.Is(err, ErrBadHintQuery) {
+    t.Fatalf("Got %v, want ErrBadHintQuery", err)
+  }
+
+  // A query under another client's key does not decrypt to a secret
+  if err := client.RecoverDelegated(hq, hans); !errors.Is(err, ErrBadDelegatedQuery) {
+    t.Fatalf("Got %v, want ErrBadDelegatedQuery", err)
+  }
+
+  // A truncated query
+  short := (*hq)[:len(*hq)-1]
+  if err := other.RecoverDelegated(&short, hans); !errors.Is(err, ErrBadDelegatedQuery) {
+    t.Fatalf("Got %v, want ErrBadDelegatedQuery", err)
+  }
+
+  // A truncated answer
+  hans.HintCts = hans.HintCts[1:]
+  if err := other.RecoverDelegated(hq, hans); !errors.Is(err, ErrBadHintAnswer) {
+    t.Fatalf("Got %v, want ErrBadHintAnswer", err)
+  }
+}
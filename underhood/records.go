@@ -0,0 +1,181 @@
+package underhood
+
+import (
+  "errors"
+  "encoding/binary"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+// Each record is prefixed with its length (in bytes), so that records
+// of different sizes can share one database layout.
+const recordHeaderLen = 4
+
+var ErrMalformedRecord = errors.New("underhood: malformed record")
+var ErrRecordIndex = errors.New("underhood: record index out of range")
+
+// Public layout of a database of byte records. The client needs this
+// (along with db.Info) to find and decode a record.
+//
+// Each record is padded to MaxLen bytes, prefixed with its length, and
+// split into ElemsPerRecord Z_p elements of BitsPerElem bits each. These
+// elements are stacked vertically in a single database column, so that
+// one SimplePIR answer contains the whole record.
+type RecordInfo struct {
+  Num            uint64 // number of records
+  MaxLen         uint64 // length (in bytes) of the longest record
+  BitsPerElem    uint64 // number of record bits packed into each Z_p element
+  ElemsPerRecord uint64 // number of Z_p elements per record
+  M              uint64 // database width
+}
+
+func newRecordInfo(num, maxLen uint64, params *lwe.Params) *RecordInfo {
+  bits := uint64(0)
+  for (uint64(1) << (bits+1)) <= params.P {
+    bits += 1
+  }
+
+  if bits == 0 {
+    panic("P is too small to encode records")
+  }
+
+  totalBits := 8*(recordHeaderLen + maxLen)
+  return &RecordInfo{
+    Num: num,
+    MaxLen: maxLen,
+    BitsPerElem: bits,
+    ElemsPerRecord: (totalBits + bits - 1)/bits,
+    M: params.M,
+  }
+}
+
+// Build a database holding the given records, of arbitrary (and possibly
+// differing) lengths.
+func NewRecordDatabase[T matrix.Elem](records [][]byte, params *lwe.Params) (*pir.Database[T], *RecordInfo) {
+  if len(records) == 0 {
+    panic("Empty database!")
+  }
+
+  maxLen := uint64(0)
+  for _, rec := range records {
+    if uint64(len(rec)) > maxLen {
+      maxLen = uint64(len(rec))
+    }
+  }
+
+  if maxLen >= (1 << (8*recordHeaderLen)) {
+    panic("Record is too long")
+  }
+
+  info := newRecordInfo(uint64(len(records)), maxLen, params)
+
+  // Records are laid out column by column: record i lives in column
+  // (i % M), in the (i / M)-th block of ElemsPerRecord rows.
+  k := info.ElemsPerRecord
+  rows := ((info.Num + info.M - 1)/info.M) * k
+  vals := make([]uint64, rows * info.M)
+
+  for i, rec := range records {
+    col := uint64(i) % info.M
+    start := (uint64(i) / info.M) * k
+    for j, v := range info.encode(rec) {
+      vals[(start + uint64(j))*info.M + col] = v
+    }
+  }
+
+  // db.Info counts the elements of the records, not the padding
+  db := pir.NewDatabaseFixedParams[T](uint64(len(vals)), info.BitsPerElem, vals, params)
+  db.Info.Num = info.Num * k
+  return db, info
+}
+
+// Get 'n' bits of 'buf', starting at bit 'off'. Bits past the end of
+// 'buf' are zero.
+func getBits(buf []byte, off, n uint64) uint64 {
+  v := uint64(0)
+  for i := uint64(0); i < n; i++ {
+    bit := off + i
+    if bit/8 >= uint64(len(buf)) {
+      break
+    }
+    v |= uint64((buf[bit/8] >> (bit%8)) & 1) << i
+  }
+  return v
+}
+
+// Set 'n' bits of 'buf', starting at bit 'off', to the low-order bits of 'v'.
+// Bits past the end of 'buf' must be zero.
+func setBits(buf []byte, off, n, v uint64) bool {
+  for i := uint64(0); i < n; i++ {
+    bit := off + i
+    b := byte((v >> i) & 1)
+    if bit/8 >= uint64(len(buf)) {
+      if b != 0 {
+        return false
+      }
+      continue
+    }
+    buf[bit/8] |= b << (bit%8)
+  }
+  return true
+}
+
+func (info *RecordInfo) encode(rec []byte) []uint64 {
+  buf := make([]byte, recordHeaderLen + info.MaxLen)
+  binary.LittleEndian.PutUint32(buf, uint32(len(rec)))
+  copy(buf[recordHeaderLen:], rec)
+
+  out := make([]uint64, info.ElemsPerRecord)
+  for i := range out {
+    out[i] = getBits(buf, uint64(i)*info.BitsPerElem, info.BitsPerElem)
+  }
+  return out
+}
+
+func (info *RecordInfo) decode(vals []uint64) ([]byte, error) {
+  if uint64(len(vals)) != info.ElemsPerRecord {
+    return nil, ErrMalformedRecord
+  }
+
+  buf := make([]byte, recordHeaderLen + info.MaxLen)
+  for i, v := range vals {
+    if v >= (1 << info.BitsPerElem) {
+      return nil, ErrMalformedRecord
+    }
+    if !setBits(buf, uint64(i)*info.BitsPerElem, info.BitsPerElem, v) {
+      return nil, ErrMalformedRecord
+    }
+  }
+
+  l := uint64(binary.LittleEndian.Uint32(buf))
+  if l > info.MaxLen {
+    return nil, ErrMalformedRecord
+  }
+
+  return buf[recordHeaderLen:recordHeaderLen+l], nil
+}
+
+func (c *Client[T]) QueryRecord(info *RecordInfo, i uint64) (*pir.Query[T], error) {
+  if i >= info.Num {
+    panic("Record index out of range")
+  }
+  return c.Query(i % info.M)
+}
+
+// Recover the i-th record, given the server's answer to QueryRecord(info, i).
+// Returns ErrRecordIndex if there is no record i.
+func (c *Client[T]) RecoverRecord(info *RecordInfo, i uint64, ans *pir.Answer[T]) ([]byte, error) {
+  if i >= info.Num {
+    return nil, ErrRecordIndex
+  }
+  vals := c.Recover(ans)
+
+  start := (i / info.M) * info.ElemsPerRecord
+  stop := start + info.ElemsPerRecord
+  if stop > uint64(len(vals)) {
+    return nil, ErrMalformedRecord
+  }
+
+  return info.decode(vals[start:stop])
+}
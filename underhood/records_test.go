@@ -0,0 +1,134 @@
+package underhood
+
+import (
+  "bytes"
+  "testing"
+  mrand "math/rand"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func randRecords(num, maxLen int) [][]byte {
+  r := mrand.New(mrand.NewSource(99))
+  out := make([][]byte, num)
+  for i := range out {
+    out[i] = make([]byte, r.Intn(maxLen+1))
+    r.Read(out[i])
+  }
+  return out
+}
+
+func TestRecordEncoding(t *testing.T) {
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  recs := randRecords(100, 37)
+  recs = append(recs, []byte{})
+
+  info := newRecordInfo(uint64(len(recs)), 37, params)
+  if info.BitsPerElem != 9 {
+    t.Fatalf("Expected 9 bits per element, got %v", info.BitsPerElem)
+  }
+
+  for i, rec := range recs {
+    vals := info.encode(rec)
+    for _, v := range vals {
+      if v >= params.P {
+        t.Fatalf("Encoded value %v is too big", v)
+      }
+    }
+
+    dec, err := info.decode(vals)
+    if err != nil || !bytes.Equal(dec, rec) {
+      t.Fatalf("Record %v: decoding failed", i)
+    }
+  }
+
+  // Corrupt the length header
+  vals := info.encode(recs[0])
+  vals[0] = (1 << info.BitsPerElem) - 1
+  vals[1] = (1 << info.BitsPerElem) - 1
+  if _, err := info.decode(vals); err != ErrMalformedRecord {
+    t.Fail()
+  }
+}
+
+func TestRecordLayout(t *testing.T) {
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  recs := randRecords(3000, 20)
+  db, info := NewRecordDatabase[matrix.Elem64](recs, params)
+
+  for i, rec := range recs {
+    col := uint64(i) % info.M
+    start := (uint64(i) / info.M) * info.ElemsPerRecord
+    vals := make([]uint64, info.ElemsPerRecord)
+    for j := range vals {
+      vals[j] = uint64(db.Data.Get(start + uint64(j), col))
+    }
+
+    dec, err := info.decode(vals)
+    if err != nil || !bytes.Equal(dec, rec) {
+      t.Fatalf("Record %v: decoding failed", i)
+    }
+  }
+}
+
+func testRecordPIR[IntT matrix.Elem](t *testing.T, num, maxLen int) {
+  pMod := uint64(512)
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), 1<<10, pMod)
+  recs := randRecords(num, maxLen)
+  db, info := NewRecordDatabase[IntT](recs, params)
+
+  server := NewServer(db, seed)
+  defer server.Free()
+
+  for _, idx := range []uint64{0, 7, uint64(num-1)} {
+    client := NewClient[IntT](seed, db.Info)
+    defer client.Free()
+
+    // Token-generation phase
+    hq := client.HintQuery()
+    hans, err := server.HintAnswer(hq)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err := client.HintRecover(hans); err != nil {
+      t.Fatal(err)
+    }
+    client.PreprocessQuery()
+
+    // Query phase
+    q, err := client.QueryRecord(info, idx)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ans, err := server.Answer(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if _, err := client.RecoverRecord(info, info.Num, ans); err != ErrRecordIndex {
+      t.Fatalf("Got %v, want ErrRecordIndex", err)
+    }
+    rec, err := client.RecoverRecord(info, idx, ans)
+
+    if err != nil || !bytes.Equal(rec, recs[idx]) {
+      t.Fail()
+    }
+  }
+}
+
+func TestRecordPIRSmall64(t *testing.T) {
+  testRecordPIR[matrix.Elem64](t, 1<<10, 100)
+}
+
+func TestRecordPIRMed64(t *testing.T) {
+  testRecordPIR[matrix.Elem64](t, 1<<14, 1000)
+}
+
+func TestRecordPIRSmall32(t *testing.T) {
+  testRecordPIR[matrix.Elem32](t, 1<<10, 100)
+}
+
+func TestRecordPIRMed32(t *testing.T) {
+  testRecordPIR[matrix.Elem32](t, 1<<14, 1000)
+}
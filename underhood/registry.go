@@ -0,0 +1,219 @@
+package underhood
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "errors"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+)
+
+// A Registry hosts many databases (e.g., shards, or versions of a database)
+// in one process, and routes requests to them by database ID. All of the
+// databases share one RLWE context. Databases can be added and retired
+// while the registry serves requests: retiring a database waits for its
+// in-flight requests to finish before freeing it.
+
+var ErrUnknownDatabase = errors.New("underhood: unknown database")
+var ErrDuplicateDatabase = errors.New("underhood: database already exists")
+var ErrRegistryClosed = errors.New("underhood: registry is closed")
+
+type registryEntry struct {
+  server   any // *Server[T]
+  free     func()
+  inflight sync.WaitGroup
+}
+
+type Registry struct {
+  params *params
+
+  mu     sync.RWMutex
+  dbs    map[string]*registryEntry
+  closed bool
+}
+
+// Beware! You must call Close() on the output Registry to clean up C++ objects.
+func NewRegistry() *Registry {
+  return &Registry{
+    params: newParams(),
+    dbs: make(map[string]*registryEntry),
+  }
+}
+
+// Add the database 'db' (with matrix A seed 'matrixAseed') under 'id'.
+func AddDatabase[T matrix.Elem](r *Registry, id string, db *pir.Database[T], matrixAseed *rand.PRGKey) error {
+  if err := CheckSecurity(db.Info.Params); err != nil {
+    return err
+  }
+
+  // Check for duplicates before doing the (expensive) hint preprocessing
+  r.mu.RLock()
+  _, exists := r.dbs[id]
+  closed := r.closed
+  r.mu.RUnlock()
+  if closed {
+    return ErrRegistryClosed
+  }
+  if exists {
+    return fmt.Errorf("%w: %q", ErrDuplicateDatabase, id)
+  }
+
+  pirServer := pir.NewServerSeed(db, matrixAseed)
+  inner := simplePIRServer[T]{ Server: pirServer }
+  s := &Server[T]{
+    tokens: newTokenServer[T](r.params, inner),
+    pirServer: pirServer,
+    inner: inner,
+    data: db.Data,
+  }
+
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if _, exists := r.dbs[id]; exists || r.closed {
+    s.Free()
+    if r.closed {
+      return ErrRegistryClosed
+    }
+    return fmt.Errorf("%w: %q", ErrDuplicateDatabase, id)
+  }
+
+  r.dbs[id] = &registryEntry{
+    server: s,
+    free: s.Free,
+  }
+  return nil
+}
+
+// Stop serving the database 'id', and free it once its in-flight requests
+// have finished.
+func (r *Registry) Retire(id string) error {
+  r.mu.Lock()
+  e, ok := r.dbs[id]
+  delete(r.dbs, id)
+  r.mu.Unlock()
+
+  if !ok {
+    return fmt.Errorf("%w: %q", ErrUnknownDatabase, id)
+  }
+
+  e.inflight.Wait()
+  e.free()
+  return nil
+}
+
+// IDs of the databases currently served, in sorted order.
+func (r *Registry) IDs() []string {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  out := make([]string, 0, len(r.dbs))
+  for id := range r.dbs {
+    out = append(out, id)
+  }
+  sort.Strings(out)
+  return out
+}
+
+// Retire all databases, and clean up. Calls after the first do nothing.
+func (r *Registry) Close() {
+  r.mu.Lock()
+  if r.closed {
+    r.mu.Unlock()
+    return
+  }
+  r.closed = true
+  ids := make([]string, 0, len(r.dbs))
+  for id := range r.dbs {
+    ids = append(ids, id)
+  }
+  r.mu.Unlock()
+
+  for _, id := range ids {
+    r.Retire(id)
+  }
+  r.params.Free()
+}
+
+// Look up the database 'id', and mark a request to it as in flight. The
+// caller must call done() once the request has finished.
+func (r *Registry) acquire(id string) (e *registryEntry, done func(), err error) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  e, ok := r.dbs[id]
+  if !ok {
+    return nil, nil, fmt.Errorf("%w: %q", ErrUnknownDatabase, id)
+  }
+
+  e.inflight.Add(1)
+  return e, e.inflight.Done, nil
+}
+
+type hintAnswerer interface {
+  HintAnswer(q *HintQuery) (*HintAnswer, error)
+}
+
+func (r *Registry) HintAnswer(id string, q *HintQuery) (*HintAnswer, error) {
+  e, done, err := r.acquire(id)
+  if err != nil {
+    return nil, err
+  }
+  defer done()
+
+  return e.server.(hintAnswerer).HintAnswer(q)
+}
+
+func lookupServer[T matrix.Elem](r *Registry, id string) (*Server[T], func(), error) {
+  e, done, err := r.acquire(id)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  s, ok := e.server.(*Server[T])
+  if !ok {
+    done()
+    return nil, nil, fmt.Errorf("%w: database %q does not hold %d-bit values",
+                                ErrBadQuery, id, T(0).Bitlen())
+  }
+  return s, done, nil
+}
+
+// Answer a query to the database 'id'.
+func RegistryAnswer[T matrix.Elem](r *Registry, id string, q *pir.Query[T]) (*pir.Answer[T], error) {
+  s, done, err := lookupServer[T](r, id)
+  if err != nil {
+    return nil, err
+  }
+  defer done()
+
+  return s.Answer(q)
+}
+
+// Answer a multi-column LHE query to the database 'id'.
+func RegistryAnswerMany[T matrix.Elem](r *Registry, id string, q *pir.Query[T]) (*pir.Answer[T], error) {
+  s, done, err := lookupServer[T](r, id)
+  if err != nil {
+    return nil, err
+  }
+  defer done()
+
+  return s.AnswerMany(q)
+}
+
+// The Transport for the database 'id', to fetch tokens from a Registry
+// (e.g., in a TokenPool).
+func (r *Registry) Transport(id string) Transport {
+  return registryTransport{ r, id }
+}
+
+type registryTransport struct {
+  r  *Registry
+  id string
+}
+
+func (t registryTransport) HintAnswer(q *HintQuery) (*HintAnswer, error) {
+  return t.r.HintAnswer(t.id, q)
+}
@@ -0,0 +1,142 @@
+package underhood
+
+import (
+  "sync"
+  "errors"
+  "reflect"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func registryPIR[T matrix.Elem](t *testing.T, r *Registry, id string, seed *rand.PRGKey, db *pir.Database[T]) {
+  client := NewClient[T](seed, db.Info)
+  defer client.Free()
+
+  hans, err := r.HintAnswer(id, client.HintQuery())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  idx := uint64(9)
+  q, err := client.Query(idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := RegistryAnswer(r, id, q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if client.Recover(ans)[0] != db.GetElem(idx) {
+    t.Fail()
+  }
+}
+
+func TestRegistry(t *testing.T) {
+  r := NewRegistry()
+  defer r.Close()
+
+  seed64 := rand.RandomPRGKey()
+  seed32 := rand.RandomPRGKey()
+  params64 := lwe.NewParamsFixedP(64, 1<<10, 512)
+  params32 := lwe.NewParamsFixedP(32, 1<<10, 512)
+  db64 := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 1, params64)
+  db32 := pir.NewDatabaseRandomFixedParams[matrix.Elem32](rand.NewRandomBufPRG(), 1<<10, 1, params32)
+
+  if err := AddDatabase(r, "shard64", db64, seed64); err != nil {
+    t.Fatal(err)
+  }
+  if err := AddDatabase(r, "shard32", db32, seed32); err != nil {
+    t.Fatal(err)
+  }
+  if err := AddDatabase(r, "shard32", db32, seed32); !errors.Is(err, ErrDuplicateDatabase) {
+    t.Errorf("Expected ErrDuplicateDatabase, got %v", err)
+  }
+  if !reflect.DeepEqual(r.IDs(), []string{ "shard32", "shard64" }) {
+    t.Fatalf("Unexpected IDs: %v", r.IDs())
+  }
+
+  registryPIR(t, r, "shard64", seed64, db64)
+  registryPIR(t, r, "shard32", seed32, db32)
+
+  // Queries of the wrong width, or to unknown databases, are refused
+  q := &pir.Query[matrix.Elem32]{ Query: matrix.Zeros[matrix.Elem32](1024, 1) }
+  if _, err := RegistryAnswer(r, "shard64", q); !errors.Is(err, ErrBadQuery) {
+    t.Errorf("Expected ErrBadQuery, got %v", err)
+  }
+  if _, err := RegistryAnswer(r, "nope", q); !errors.Is(err, ErrUnknownDatabase) {
+    t.Errorf("Expected ErrUnknownDatabase, got %v", err)
+  }
+
+  // Retire a database, and hot-add a new version under the same ID
+  if err := r.Retire("shard32"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := r.HintAnswer("shard32", &HintQuery{}); !errors.Is(err, ErrUnknownDatabase) {
+    t.Errorf("Expected ErrUnknownDatabase, got %v", err)
+  }
+
+  db32 = pir.NewDatabaseRandomFixedParams[matrix.Elem32](rand.NewRandomBufPRG(), 1<<10, 1, params32)
+  if err := AddDatabase(r, "shard32", db32, seed32); err != nil {
+    t.Fatal(err)
+  }
+  registryPIR(t, r, "shard32", seed32, db32)
+}
+
+func TestRegistryRetireInFlight(t *testing.T) {
+  r := NewRegistry()
+  defer r.Close()
+
+  seed := rand.RandomPRGKey()
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<12, 1, params)
+  if err := AddDatabase(r, "db", db, seed); err != nil {
+    t.Fatal(err)
+  }
+
+  client := NewClient[matrix.Elem64](seed, db.Info)
+  defer client.Free()
+  hq := client.HintQuery()
+
+  // Requests that race with Retire either succeed or find no database
+  var wg sync.WaitGroup
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if _, err := r.HintAnswer("db", hq); err != nil && !errors.Is(err, ErrUnknownDatabase) {
+        t.Error(err)
+      }
+    }()
+  }
+
+  if err := r.Retire("db"); err != nil {
+    t.Fatal(err)
+  }
+  wg.Wait()
+
+  if len(r.IDs()) != 0 {
+    t.Fail()
+  }
+}
+
+func TestRegistryClosed(t *testing.T) {
+  r := NewRegistry()
+  r.Close()
+
+  seed := rand.RandomPRGKey()
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<10, 1, params)
+  if err := AddDatabase(r, "db", db, seed); !errors.Is(err, ErrRegistryClosed) {
+    t.Errorf("Expected ErrRegistryClosed, got %v", err)
+  }
+
+  // Closing again does nothing
+  r.Close()
+}
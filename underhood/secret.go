@@ -3,10 +3,12 @@ package underhood
 import (
   "fmt"
   "github.com/henrycg/simplepir/matrix"
+  "github.com/ahenzinger/underhood/rlwe"
 )
 
-// Bound on norm of entries of secret for the "inner" encryption scheme.
-// We use ternary secrets in the range [0, 1, 2].
+// Bound on norm of entries of secret for SimplePIR (other inner schemes
+// set their own; see InnerParams). We use ternary secrets in the range
+// [0, 1, 2].
 const SecretMin = 0
 const SecretMax = 2
 
@@ -27,39 +29,44 @@ func fromModuloP[T matrix.Elem](p uint64, v uint64) T {
 }
 
 // Warning: works because secret values cna't be negative!
-func inRange[T matrix.Elem](val T) bool {
-  if (val >= SecretMin) && (val <= SecretMax) {
-    return true
-  }
-  return false
+func (c *TokenClient[T]) inRange(val uint64) bool {
+  smin, smax := c.inner.SecretBounds()
+  return (val >= smin) && (val <= smax)
 }
 
-func (c *Client[T]) encryptSecret(innerSecret *matrix.Matrix[T]) (KeyBlob, []CipherBlob) {
-  outerSecret := c.params.ctx.NewKey()
-  defer outerSecret.Free()
-
-  if innerSecret.Cols() != 1 {
-    panic("Secret should be a column vector")
+// The secret may have several columns (one per LHE message column). The
+// columns are encrypted one after the other, so a one-column secret is
+// encrypted exactly as before.
+func (c *TokenClient[T]) encryptSecret(innerSecret *matrix.Matrix[T]) (*rlwe.Seed, []CipherBlob) {
+  seed := c.outerSeed
+  if !c.fixedKey {
+    seed = c.newKeySeed()
   }
+  outerSecret := c.params.ctx.NewKeyFromSeed(seed)
+  defer outerSecret.Free()
 
-  if c.params.ctx.P() < SecretMax {
+  if _, smax := c.inner.SecretBounds(); c.params.ctx.P() <= smax {
     panic("P is too small to encode secret")
   }
 
   // Encrypt each element of the secret key in its own ciphertext
-  data := innerSecret.Data()
-  cts := make([]CipherBlob, len(data))
-  for i := 0; i < len(innerSecret.Data()); i++ {
-    if !inRange[T](data[i]) {
-      fmt.Printf("At %v: %v\n", i, data[i])
-      panic("Secret is not in expected range")
-    }
+  rows := innerSecret.Rows()
+  cols := innerSecret.Cols()
+  cts := make([]CipherBlob, rows*cols)
+  for j := uint64(0); j < cols; j++ {
+    for i := uint64(0); i < rows; i++ {
+      v := innerSecret.Get(i, j)
+      if !c.inRange(uint64(v)) {
+        fmt.Printf("At %v,%v: %v\n", i, j, v)
+        panic("Secret is not in expected range")
+      }
 
-    vals := make([]uint64, c.params.ctx.N())
-    vals[0] = uint64(data[i]) // Warning: works because secret can't be negative!
+      vals := make([]uint64, c.params.ctx.N())
+      vals[0] = uint64(v) // Warning: works because secret can't be negative!
 
-    cts[i] = outerSecret.EncryptSquishedSlice(c.params.ctx, vals)
+      cts[j*rows + i] = outerSecret.EncryptSquishedSlice(c.params.ctx, vals)
+    }
   }
 
-  return outerSecret.Store(), cts
+  return seed, cts
 }
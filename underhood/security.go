@@ -0,0 +1,77 @@
+package underhood
+
+import (
+  "fmt"
+  "sync"
+  "math"
+  "errors"
+  "sync/atomic"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/ahenzinger/underhood/underhood/security"
+)
+
+// An optional check that the SimplePIR LWE parameters, and the BFV
+// parameters that encrypt the SimplePIR secret, meet a minimum estimated
+// security level (see underhood/security for the model). The check is off
+// by default. Once enabled with SetMinSecurityBits, NewServer, NewClient
+// and NewClientDistributed panic on parameters below the threshold, and
+// AddDatabase returns an error wrapping ErrInsecure.
+
+var ErrInsecure = errors.New("underhood: parameters are below the minimum security level")
+
+// Minimum classical security, in bits (as a float64 bit pattern).
+var minSecurityBits atomic.Uint64
+
+// Estimates, by LWE instance (the estimate is deterministic but not free).
+var securityCache sync.Map
+
+// Require an estimated classical security of at least 'bits' bits for both
+// the LWE and the RLWE parameters. Zero disables the check.
+func SetMinSecurityBits(bits float64) {
+  minSecurityBits.Store(math.Float64bits(bits))
+}
+
+func estimateSecurity(p security.LWE) security.Estimate {
+  if e, ok := securityCache.Load(p); ok {
+    return e.(security.Estimate)
+  }
+  e := p.Estimate()
+  securityCache.Store(p, e)
+  return e
+}
+
+// Check the parameters against the threshold set by SetMinSecurityBits.
+func CheckSecurity(params *lwe.Params) error {
+  min := math.Float64frombits(minSecurityBits.Load())
+  if min <= 0 {
+    return nil
+  }
+
+  if err := checkEstimate(security.SimplePIR(params), "SimplePIR", min); err != nil {
+    return err
+  }
+  return checkEstimate(security.BFV(), "BFV", min)
+}
+
+// Check the BFV parameters of public-key mode (see publickey.go).
+func checkPublicSecurity() error {
+  min := math.Float64frombits(minSecurityBits.Load())
+  if min <= 0 {
+    return nil
+  }
+  return checkEstimate(security.BFVPublic(), "public-key BFV", min)
+}
+
+func checkEstimate(p security.LWE, name string, min float64) error {
+  if e := estimateSecurity(p); e.Classical < min {
+    return fmt.Errorf("%w: %s parameters give %.1f bits, want %.1f",
+                      ErrInsecure, name, e.Classical, min)
+  }
+  return nil
+}
+
+func mustBeSecure(params *lwe.Params) {
+  if err := CheckSecurity(params); err != nil {
+    panic(err)
+  }
+}
@@ -0,0 +1,139 @@
+package security
+
+import (
+  "math"
+  "github.com/henrycg/simplepir/lwe"
+)
+
+// Estimates of the security of the two lattice problems that the scheme
+// relies on: LWE, for SimplePIR, and RLWE, for the BFV encryption of the
+// SimplePIR secret.
+//
+// We use the "core-SVP" model of Alkim, Ducas, Poppelmann and Schwabe
+// (NewHope, USENIX Security 2016), as is common for lattice schemes: the
+// attack is the primal attack, which solves unique-SVP in an embedding
+// lattice with BKZ, and its cost is that of one call to an SVP oracle in
+// dimension beta (the BKZ block size): 2^(0.292 beta) classically and
+// 2^(0.265 beta) quantumly. We scale the secret to the size of the error,
+// as in Bai and Galbraith (ACISP 2014), to handle small secrets. We treat
+// RLWE as LWE, with one ring element's worth (n) of samples.
+//
+// The model ignores the polynomial factors of BKZ and the dual and hybrid
+// attacks, so it is only an estimate: use the lattice estimator
+// (https://github.com/malb/lattice-estimator) for a final choice of
+// parameters. It is conservative with respect to the number of calls to
+// the SVP oracle, which it takes to be one.
+
+// An LWE instance.
+type LWE struct {
+  N         uint64  // secret dimension
+  LogQ      float64 // log2 of the modulus
+  Sigma     float64 // error standard deviation
+  SecretStd float64 // secret standard deviation
+  Samples   uint64  // number of samples available to the attacker
+}
+
+type Estimate struct {
+  BlockSize uint64  // BKZ block size of the cheapest primal attack
+  Dim       uint64  // dimension of the attack lattice
+  Classical float64 // log2 of the attack's classical cost
+  Quantum   float64 // log2 of the attack's quantum cost
+}
+
+// The standard deviation of a secret uniform over 'size' consecutive integers.
+func uniformStd(size uint64) float64 {
+  return math.Sqrt(float64(size*size - 1) / 12)
+}
+
+// The SimplePIR LWE instance. SimplePIR's secrets are ternary, and the
+// attacker sees one sample per database column.
+func SimplePIR(params *lwe.Params) LWE {
+  return LWE{
+    N: params.N,
+    LogQ: float64(params.Logq),
+    Sigma: params.Sigma,
+    SecretStd: uniformStd(3),
+    Samples: params.M,
+  }
+}
+
+// The BFV context in rlwe/rlwe.cpp: ring dimension 2048, one 38-bit
+// modulus, ternary secrets and SEAL's default error.
+func BFV() LWE {
+  return LWE{
+    N: 2048,
+    LogQ: 38,
+    Sigma: 3.19,
+    SecretStd: uniformStd(3),
+    Samples: 2048,
+  }
+}
+
+// The public-key BFV context in rlwe/rlwe.cpp: ring dimension 4096, one
+// 54-bit modulus.
+func BFVPublic() LWE {
+  return LWE{
+    N: 4096,
+    LogQ: 54,
+    Sigma: 3.19,
+    SecretStd: uniformStd(3),
+    Samples: 4096,
+  }
+}
+
+// log2 of the root-Hermite factor that BKZ with block size 'beta' achieves.
+func logDelta(beta float64) float64 {
+  d := math.Log2(math.Pow(math.Pi*beta, 1/beta) * beta / (2*math.Pi*math.E))
+  return d / (2*(beta - 1))
+}
+
+// Whether the primal attack with block size 'beta' and 'm' samples succeeds:
+// sigma sqrt(beta) <= delta^(2 beta - d - 1) vol^(1/d), for the embedding
+// lattice of dimension d = m + n + 1 and volume q^m (sigma/secretStd)^n.
+func primalSucceeds(p LWE, beta, m float64) bool {
+  n := float64(p.N)
+  d := m + n + 1
+  logVol := m*p.LogQ + n*math.Log2(p.Sigma/p.SecretStd)
+  lhs := math.Log2(p.Sigma) + math.Log2(beta)/2
+  rhs := (2*beta - d - 1)*logDelta(beta) + logVol/d
+  return lhs <= rhs
+}
+
+const minBlockSize = 50
+const maxBlockSize = 4000
+
+// Estimate the security of the LWE instance, as the cost of the cheapest
+// primal attack. If no block size up to maxBlockSize works, the estimate
+// is a lower bound.
+func (p LWE) Estimate() Estimate {
+  if p.N == 0 || p.Sigma <= 0 || p.SecretStd <= 0 {
+    panic("Bad LWE parameters")
+  }
+
+  for beta := uint64(minBlockSize); beta < maxBlockSize; beta++ {
+    // The attack may use fewer samples than it is given
+    for m := uint64(1); m <= p.Samples; m += mStep(p.Samples) {
+      if primalSucceeds(p, float64(beta), float64(m)) {
+        return newEstimate(beta, m + p.N + 1)
+      }
+    }
+  }
+  return newEstimate(maxBlockSize, 0)
+}
+
+// Step through the number of samples in (at most) 512 increments.
+func mStep(samples uint64) uint64 {
+  if samples < 512 {
+    return 1
+  }
+  return samples / 512
+}
+
+func newEstimate(beta, dim uint64) Estimate {
+  return Estimate{
+    BlockSize: beta,
+    Dim: dim,
+    Classical: 0.292 * float64(beta),
+    Quantum: 0.265 * float64(beta),
+  }
+}
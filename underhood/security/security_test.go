@@ -0,0 +1,67 @@
+package security
+
+import (
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+)
+
+func TestBFV(t *testing.T) {
+  e := BFV().Estimate()
+  t.Logf("BFV: %+v", e)
+  if e.Classical < 128 {
+    t.Errorf("BFV parameters give only %.1f bits", e.Classical)
+  }
+}
+
+func TestBFVPublic(t *testing.T) {
+  e := BFVPublic().Estimate()
+  t.Logf("BFV (public key): %+v", e)
+  if e.Classical < 128 {
+    t.Errorf("Public-key BFV parameters give only %.1f bits", e.Classical)
+  }
+}
+
+func TestSimplePIR(t *testing.T) {
+  for _, logq := range []uint64{ 32, 64 } {
+    e := SimplePIR(lwe.NewParamsFixedP(logq, 1<<10, 512)).Estimate()
+    t.Logf("SimplePIR, %d-bit: %+v", logq, e)
+    if e.Classical < 100 {
+      t.Errorf("%d-bit SimplePIR parameters give only %.1f bits", logq, e.Classical)
+    }
+  }
+}
+
+func TestMonotone(t *testing.T) {
+  base := BFV()
+  e := base.Estimate()
+
+  // A larger modulus, a smaller error or a smaller dimension are easier to attack
+  p := base
+  p.LogQ = 54
+  if p.Estimate().BlockSize >= e.BlockSize {
+    t.Error("Larger modulus is not less secure")
+  }
+
+  p = base
+  p.Sigma = 1
+  if p.Estimate().BlockSize >= e.BlockSize {
+    t.Error("Smaller error is not less secure")
+  }
+
+  p = base
+  p.N = 1024
+  p.Samples = 1024
+  if p.Estimate().BlockSize >= e.BlockSize {
+    t.Error("Smaller dimension is not less secure")
+  }
+
+  // Known reference point: n=1024, q=2^27, ternary secret (the homomorphic
+  // encryption standard's 128-bit setting) is close to 128 bits
+  p = base
+  p.N = 1024
+  p.Samples = 1024
+  p.LogQ = 27
+  if c := p.Estimate().Classical; c < 100 || c > 150 {
+    t.Errorf("Reference point gives %.1f bits", c)
+  }
+}
@@ -0,0 +1,41 @@
+package underhood
+
+import (
+  "errors"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func TestSecurityThreshold(t *testing.T) {
+  defer SetMinSecurityBits(0)
+
+  params := lwe.NewParamsFixedP(64, 1<<10, 512)
+  if err := CheckSecurity(params); err != nil {
+    t.Fatal(err)
+  }
+
+  SetMinSecurityBits(100)
+  if err := CheckSecurity(params); err != nil {
+    t.Fatal(err)
+  }
+
+  // A toy secret dimension
+  weak := *params
+  weak.N = 256
+  if err := CheckSecurity(&weak); !errors.Is(err, ErrInsecure) {
+    t.Errorf("Expected ErrInsecure, got %v", err)
+  }
+
+  // An unreachable threshold: constructors refuse
+  SetMinSecurityBits(1000)
+  info := pir.NewDBInfoFixedParams(1<<10, 9, params, true)
+  defer func() {
+    if r := recover(); r == nil {
+      t.Error("NewClient accepted insecure parameters")
+    }
+  }()
+  NewClient[matrix.Elem64](rand.RandomPRGKey(), info)
+}
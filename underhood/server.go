@@ -1,50 +1,108 @@
 package underhood
 
 import (
+  "fmt"
+  "sync"
+  "errors"
   "github.com/henrycg/simplepir/matrix"
   "github.com/henrycg/simplepir/pir"
   "github.com/henrycg/simplepir/rand"
 )
 
+// Errors returned by the server on malformed client input. Use errors.Is
+// to test for them: the returned errors wrap these with more detail.
+var ErrBadHintQuery = errors.New("underhood: malformed hint query")
+var ErrBadQuery = errors.New("underhood: malformed query")
+var ErrNoDatabase = errors.New("underhood: server holds no database")
+
+// Bound on the number of secret vectors in one HintQuery (and so on the
+// number of columns in one LHE query), to bound the server's work per query.
+const MaxSecretsPerQuery = 64
+
 type Server[T matrix.Elem] struct {
-  params    *params
+  tokens    *TokenServer[T]
   pirServer *pir.Server[T]
-  hint      *hintDecomp
+  inner     InnerServer[T] // source of the hint
+
+  // The database, squished in blocks of rows on the first AnswerMany
+  // (pirServer keeps its squished copy private). Until then, data refers
+  // to the caller's db.Data; it is not a copy.
+  data       *matrix.Matrix[T]
+  blocksOnce sync.Once
+  blocks     []*matrix.Matrix[T]
+
+  // Tokens for delegates, under the public-key context (nil unless
+  // EnablePublicKeyMode was called; see publickey.go)
+  publicTokens *TokenServer[T]
 }
 
 // Beware! You must call Free() on the output Server to clean up C++ objects.
+// Panics if the parameters are below the threshold set by SetMinSecurityBits.
 func NewServer[T matrix.Elem](db *pir.Database[T], matrixAseed *rand.PRGKey) *Server[T] {
+  mustBeSecure(db.Info.Params)
   pirServer := pir.NewServerSeed(db, matrixAseed)
-  params := newParams()
+  inner := simplePIRServer[T]{ Server: pirServer }
   return &Server[T]{
-    params: params,
+    tokens: NewTokenServer[T](inner),
     pirServer: pirServer,
-    hint: decomposeHint(params, pirServer.Hint()),
+    inner: inner,
+    data: db.Data,
   }
 }
 
 // Beware! You must call Free() on the output Server to clean up C++ objects.
 func NewServerHintOnly[T matrix.Elem](hintIn *matrix.Matrix[T]) *Server[T] {
-  params := newParams()
+  inner := hintOnly[T]{ hint: hintIn }
   return &Server[T]{
-    params: params,
+    tokens: NewTokenServer[T](inner),
     pirServer: nil,
-    hint: decomposeHint(params, hintIn),
+    inner: inner,
   }
 }
 
 func (s *Server[T]) Free() {
-  s.hint.Free()
-  s.params.ctx.Free()
+  s.tokens.Free()
+  if s.publicTokens != nil {
+    s.publicTokens.Free()
+  }
 }
 
-func (s *Server[T]) HintAnswer(q *HintQuery) *HintAnswer {
-  return &HintAnswer{ 
-    HintCts: s.params.applyHint(s.hint, *q),
-    MatrixRows: s.hint.hintRows,
+func (s *Server[T]) HintAnswer(q *HintQuery) (*HintAnswer, error) {
+  return s.tokens.HintAnswer(q)
+}
+
+// Check that the query has the dimensions that the (squished) database
+// expects, and at most 'maxCols' columns.
+func (s *Server[T]) checkQuery(q *pir.Query[T], maxCols uint64) error {
+  if s.pirServer == nil {
+    return ErrNoDatabase
+  }
+
+  if q == nil || q.Query == nil {
+    return fmt.Errorf("%w: missing", ErrBadQuery)
   }
+
+  info := s.pirServer.DBInfo()
+  rows := ((info.M + info.Squishing - 1) / info.Squishing) * info.Squishing
+  if q.Query.Rows() != rows {
+    return fmt.Errorf("%w: got %d rows, want %d", ErrBadQuery, q.Query.Rows(), rows)
+  }
+
+  if q.Query.Cols() == 0 || q.Query.Cols() > maxCols {
+    return fmt.Errorf("%w: got %d columns, want at most %d", ErrBadQuery, q.Query.Cols(), maxCols)
+  }
+
+  if uint64(len(q.Query.Data())) != q.Query.Rows() * q.Query.Cols() {
+    return fmt.Errorf("%w: inconsistent dimensions", ErrBadQuery)
+  }
+
+  return nil
 }
 
-func (s *Server[T]) Answer(q *pir.Query[T]) *pir.Answer[T] {
-  return s.pirServer.Answer(q)
+func (s *Server[T]) Answer(q *pir.Query[T]) (*pir.Answer[T], error) {
+  if err := s.checkQuery(q, 1); err != nil {
+    return nil, err
+  }
+
+  return s.pirServer.Answer(q), nil
 }
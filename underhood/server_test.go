@@ -0,0 +1,105 @@
+package underhood
+
+import (
+  "errors"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func smallServer[IntT matrix.Elem]() (*Server[IntT], *Client[IntT]) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  params := lwe.NewParamsFixedP(IntT(0).Bitlen(), 1<<10, 512)
+  db := pir.NewDatabaseRandomFixedParams[IntT](rand.NewRandomBufPRG(), 1<<10, 1, params)
+  return NewServer(db, seed), NewClient[IntT](seed, db.Info)
+}
+
+func TestHintAnswerMalformed(t *testing.T) {
+  server, client := smallServer[matrix.Elem64]()
+  defer server.Free()
+  defer client.Free()
+
+  hq := *client.HintQuery()
+  bad := append(HintQuery{}, hq...)
+  bad[3] = bad[3][:len(bad[3])/2]
+
+  for _, q := range []*HintQuery{ nil, &HintQuery{}, &HintQuery{ hq[0] }, &bad } {
+    if _, err := server.HintAnswer(q); !errors.Is(err, ErrBadHintQuery) {
+      t.Errorf("Expected ErrBadHintQuery, got %v", err)
+    }
+  }
+}
+
+func TestAnswerMalformed(t *testing.T) {
+  server, client := smallServer[matrix.Elem64]()
+  defer server.Free()
+  defer client.Free()
+
+  rows := server.pirServer.DBInfo().M
+  for _, q := range []*pir.Query[matrix.Elem64]{
+    nil,
+    &pir.Query[matrix.Elem64]{},
+    &pir.Query[matrix.Elem64]{ Query: matrix.Zeros[matrix.Elem64](rows-1, 1) },
+    &pir.Query[matrix.Elem64]{ Query: matrix.Zeros[matrix.Elem64](2*rows, 1) },
+  } {
+    if _, err := server.Answer(q); !errors.Is(err, ErrBadQuery) {
+      t.Errorf("Expected ErrBadQuery, got %v", err)
+    }
+  }
+
+  hint := NewServerHintOnly(server.pirServer.Hint())
+  defer hint.Free()
+  if _, err := hint.Answer(&pir.Query[matrix.Elem64]{}); err != ErrNoDatabase {
+    t.Fail()
+  }
+}
+
+func FuzzAnswer(f *testing.F) {
+  server, client := smallServer[matrix.Elem32]()
+  defer server.Free()
+  defer client.Free()
+
+  f.Add(uint64(1024), uint64(1), uint64(0))
+  f.Add(uint64(1026), uint64(1), uint64(0))
+  f.Add(uint64(1026), uint64(3), uint64(7))
+
+  f.Fuzz(func(t *testing.T, rows, cols, v uint64) {
+    if rows*cols > (1<<16) {
+      t.Skip()
+    }
+
+    q := &pir.Query[matrix.Elem32]{ Query: matrix.Zeros[matrix.Elem32](rows, cols) }
+    q.Query.AddConst(matrix.Elem32(v))
+    if _, err := server.Answer(q); err != nil && !errors.Is(err, ErrBadQuery) {
+      t.Fatal(err)
+    }
+    if _, err := server.AnswerMany(q); err != nil && !errors.Is(err, ErrBadQuery) {
+      t.Fatal(err)
+    }
+  })
+}
+
+func FuzzHintAnswer(f *testing.F) {
+  server, client := smallServer[matrix.Elem32]()
+  defer server.Free()
+  defer client.Free()
+
+  hq := *client.HintQuery()
+  f.Add(hq[0], 0)
+  f.Add(hq[1][:10], 1)
+  f.Add([]byte{}, 2)
+
+  f.Fuzz(func(t *testing.T, ct []byte, at int) {
+    if at < 0 || at >= len(hq) {
+      t.Skip()
+    }
+
+    q := append(HintQuery{}, hq...)
+    q[at] = ct
+    if _, err := server.HintAnswer(&q); err != nil && !errors.Is(err, ErrBadHintQuery) {
+      t.Fatal(err)
+    }
+  })
+}
@@ -0,0 +1,148 @@
+package underhood
+
+import (
+  "fmt"
+  "errors"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/rand"
+)
+
+// One token request (HintQuery) can serve several databases, which may
+// differ in size, in width (Elem32 or Elem64) and in their matrix A. Each
+// database's client uses a prefix of the same inner secret, so each
+// database's server needs only a prefix of the encrypted secret values:
+// the client uploads the HintQuery once, and SliceHintQuery selects the
+// part of it that each server needs.
+//
+// Compatibility rules:
+// 1) the client that generated the request must use secrets at least as
+//    long as those of every other database, and
+// 2) two databases that use secrets of the same length must use different
+//    matrix A seeds: otherwise, queries to the two databases would be
+//    encrypted under the same secret and matrix A, and would reveal the
+//    difference of the queried indices (or messages).
+// Each token keeps a record of the databases it serves, shared by every
+// client it was shared to, so that rule 2 holds across all of them.
+
+var ErrIncompatibleToken = errors.New("underhood: token cannot be shared with this database")
+
+// A database that a token serves: the length of its secret, and its matrix
+// A seeds.
+type tokenUse struct {
+  dim   uint64
+  seeds []rand.PRGKey
+}
+
+type shareRecord struct {
+  uses []tokenUse
+}
+
+func sameSeeds(a, b []rand.PRGKey) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// Record that the token serves a database, or return false if it already
+// serves one with the same secret length and matrix A.
+func (r *shareRecord) add(dim uint64, seeds []rand.PRGKey) bool {
+  for _, u := range r.uses {
+    if u.dim == dim && sameSeeds(u.seeds, seeds) {
+      return false
+    }
+  }
+  r.uses = append(r.uses, tokenUse{ dim: dim, seeds: seeds })
+  return true
+}
+
+// The record of the client's current token (a new one, for a token that
+// was never shared).
+func (c *Client[T]) shareRecord() *shareRecord {
+  if c.shares == nil || c.sharesFor != any(c.tokens.innerSecret) {
+    c.shares = &shareRecord{}
+    c.shares.add(c.SecretDim(), c.seeds)
+    c.sharesFor = c.tokens.innerSecret
+  }
+  return c.shares
+}
+
+// Dimension of the client's inner secret.
+func (c *Client[T]) SecretDim() uint64 {
+  return c.pirClient.GetSecurityParam()
+}
+
+// Set up 'to' to use the token that 'from' requested with its last
+// HintQuery (or HintQueryMany). Then, 'to' recovers the answer of its own
+// database's server to SliceHintQuery(q, from.SecretDim(), to.SecretDim()).
+// Returns ErrIncompatibleToken if the token already serves a database with
+// the same secret length and matrix A as the database of 'to'.
+func ShareToken[T, U matrix.Elem](from *Client[U], to *Client[T]) error {
+  secret := from.tokens.innerSecret
+  if secret == nil {
+    return fmt.Errorf("%w: no token was requested", ErrIncompatibleToken)
+  }
+
+  fromDim := from.SecretDim()
+  toDim := to.SecretDim()
+  if toDim > fromDim {
+    return fmt.Errorf("%w: secret has dimension %d, but database needs %d",
+                      ErrIncompatibleToken, fromDim, toDim)
+  }
+
+  shares := from.shareRecord()
+  if !shares.add(toDim, to.seeds) {
+    return fmt.Errorf("%w: databases use the same secret and matrix A", ErrIncompatibleToken)
+  }
+
+  out := matrix.Zeros[T](toDim, secret.Cols())
+  for i := uint64(0); i < toDim; i++ {
+    for j := uint64(0); j < secret.Cols(); j++ {
+      out.Set(i, j, T(secret.Get(i, j)))
+    }
+  }
+
+  to.tokens.innerSecret = out
+  seed := *from.tokens.outerSeed
+  to.tokens.outerSeed = &seed
+  to.shares = shares
+  to.sharesFor = out
+
+  to.interm = nil
+  to.sk = nil
+  to.skLHE = nil
+  to.skLHEMany = nil
+  return nil
+}
+
+// Select, from a token request for secrets of dimension 'fromDim', the
+// encrypted secret values that a server for secrets of dimension 'toDim'
+// needs. This needs no secrets, so a front end can run it on behalf of
+// the servers.
+func SliceHintQuery(q *HintQuery, fromDim, toDim uint64) (*HintQuery, error) {
+  if q == nil || fromDim == 0 || uint64(len(*q)) % fromDim != 0 {
+    return nil, fmt.Errorf("%w: malformed token request", ErrBadHintQuery)
+  }
+  if toDim == 0 || toDim > fromDim {
+    return nil, fmt.Errorf("%w: cannot take %d of %d secret values", ErrIncompatibleToken, toDim, fromDim)
+  }
+
+  secrets := uint64(len(*q)) / fromDim
+  out := make(HintQuery, 0, secrets*toDim)
+  for j := uint64(0); j < secrets; j++ {
+    out = append(out, (*q)[j*fromDim:j*fromDim + toDim]...)
+  }
+  return &out, nil
+}
+
+// Deprecated: use ShareToken, which returns an error instead of panicking.
+func (c *Client[T]) CopySecret(oc *Client[matrix.Elem64]) {
+  if err := ShareToken(oc, c); err != nil {
+    panic(err)
+  }
+}
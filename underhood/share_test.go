@@ -0,0 +1,146 @@
+package underhood
+
+import (
+  "errors"
+  "testing"
+  "github.com/henrycg/simplepir/lwe"
+  "github.com/henrycg/simplepir/rand"
+  "github.com/henrycg/simplepir/pir"
+  "github.com/henrycg/simplepir/matrix"
+)
+
+func TestSliceHintQuery(t *testing.T) {
+  q := make(HintQuery, 2*5)
+  for i := range q {
+    q[i] = []byte{ byte(i) }
+  }
+
+  out, err := SliceHintQuery(&q, 5, 3)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := []byte{ 0, 1, 2, 5, 6, 7 }
+  if len(*out) != len(expected) {
+    t.Fatalf("Got %v values, want %v", len(*out), len(expected))
+  }
+  for i, v := range *out {
+    if v[0] != expected[i] {
+      t.Fail()
+    }
+  }
+
+  if _, err := SliceHintQuery(&q, 4, 3); !errors.Is(err, ErrBadHintQuery) {
+    t.Errorf("Expected ErrBadHintQuery, got %v", err)
+  }
+  if _, err := SliceHintQuery(&q, 5, 6); !errors.Is(err, ErrIncompatibleToken) {
+    t.Errorf("Expected ErrIncompatibleToken, got %v", err)
+  }
+}
+
+func checkShared[T matrix.Elem](t *testing.T, hq *HintQuery, fromDim uint64, db *pir.Database[T], server *Server[T], client *Client[T]) {
+  q, err := SliceHintQuery(hq, fromDim, client.SecretDim())
+  if err != nil {
+    t.Fatal(err)
+  }
+  hans, err := server.HintAnswer(q)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := client.HintRecover(hans); err != nil {
+    t.Fatal(err)
+  }
+  client.PreprocessQuery()
+
+  idx := uint64(5)
+  query, err := client.Query(idx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ans, err := server.Answer(query)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if client.Recover(ans)[0] != db.GetElem(idx) {
+    t.Fail()
+  }
+}
+
+func TestShareToken(t *testing.T) {
+  seed := rand.RandomPRGKey() // matrix A seed
+  otherSeed := rand.RandomPRGKey()
+  params64 := lwe.NewParamsFixedP(64, 1<<10, 512)
+  params32 := lwe.NewParamsFixedP(32, 1<<10, 512)
+
+  db64 := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<10, 1, params64)
+  dbBig := pir.NewDatabaseRandomFixedParams[matrix.Elem64](rand.NewRandomBufPRG(), 1<<14, 8, params64)
+  db32 := pir.NewDatabaseRandomFixedParams[matrix.Elem32](rand.NewRandomBufPRG(), 1<<12, 1, params32)
+
+  server64 := NewServer(db64, seed)
+  defer server64.Free()
+  serverBig := NewServer(dbBig, otherSeed)
+  defer serverBig.Free()
+  server32 := NewServer(db32, seed)
+  defer server32.Free()
+
+  client64 := NewClient[matrix.Elem64](seed, db64.Info)
+  defer client64.Free()
+  clientBig := NewClient[matrix.Elem64](otherSeed, dbBig.Info)
+  defer clientBig.Free()
+  client32 := NewClient[matrix.Elem32](seed, db32.Info)
+  defer client32.Free()
+
+  if err := ShareToken(client64, client32); !errors.Is(err, ErrIncompatibleToken) {
+    t.Errorf("Expected ErrIncompatibleToken before HintQuery, got %v", err)
+  }
+
+  // One upload serves all three databases
+  hq := client64.HintQuery()
+  dim := client64.SecretDim()
+  if err := ShareToken(client64, clientBig); err != nil {
+    t.Fatal(err)
+  }
+  if err := ShareToken(client64, client32); err != nil {
+    t.Fatal(err)
+  }
+
+  checkShared(t, hq, dim, db64, server64, client64)
+  checkShared(t, hq, dim, dbBig, serverBig, clientBig)
+  checkShared(t, hq, dim, db32, server32, client32)
+
+  // A shorter secret cannot be extended
+  client32.HintQuery()
+  if err := ShareToken(client32, client64); !errors.Is(err, ErrIncompatibleToken) {
+    t.Errorf("Expected ErrIncompatibleToken, got %v", err)
+  }
+
+  // Sharing a secret with the same matrix A is insecure
+  sameA := NewClient[matrix.Elem64](seed, dbBig.Info)
+  defer sameA.Free()
+  if err := ShareToken(client64, sameA); !errors.Is(err, ErrIncompatibleToken) {
+    t.Errorf("Expected ErrIncompatibleToken, got %v", err)
+  }
+
+  // ... and so is sharing it with two databases with the same secret
+  // length and matrix A (e.g., two shards), directly or through a client
+  // it was shared to
+  client64.HintQuery()
+  shard1 := NewClient[matrix.Elem32](seed, db32.Info)
+  defer shard1.Free()
+  shard2 := NewClient[matrix.Elem32](seed, db32.Info)
+  defer shard2.Free()
+  if err := ShareToken(client64, shard1); err != nil {
+    t.Fatal(err)
+  }
+  if err := ShareToken(client64, shard2); !errors.Is(err, ErrIncompatibleToken) {
+    t.Errorf("Expected ErrIncompatibleToken, got %v", err)
+  }
+  if err := ShareToken(shard1, shard2); !errors.Is(err, ErrIncompatibleToken) {
+    t.Errorf("Expected ErrIncompatibleToken, got %v", err)
+  }
+
+  // A new token can serve the other shard
+  client64.HintQuery()
+  if err := ShareToken(client64, shard2); err != nil {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,89 @@
+package underhood
+
+import (
+  "sync"
+  "github.com/henrycg/simplepir/matrix"
+  "github.com/henrycg/simplepir/pir"
+)
+
+// The client's state for one query: a recovered token (H x s) and the
+// matching preprocessed SimplePIR secret. A Token builds at most one query:
+// two queries under the same secret would reveal the difference of the
+// queried indices (or messages) to the server.
+//
+// A Token holds no C++ objects, and its methods are safe to call from
+// several goroutines.
+type Token[T matrix.Elem] struct {
+  pirClient *pir.Client[T]
+  interm    *matrix.Matrix[T]
+  sk        *pir.Secret[T]
+  skLHE     *pir.SecretLHE[T]
+
+  mu        sync.Mutex
+  used      bool
+}
+
+// Move the client's current token (from HintRecover, followed by
+// PreprocessQuery or PreprocessQueryLHE) into a standalone Token. The
+// client can then fetch its next token while this one waits to be used.
+func (c *Client[T]) TakeToken() *Token[T] {
+  if c.interm == nil || (c.sk == nil && c.skLHE == nil) {
+    panic("Must call HintRecover and PreprocessQuery (or PreprocessQueryLHE) first")
+  }
+
+  t := &Token[T]{
+    pirClient: c.pirClient,
+    interm: c.interm,
+    sk: c.sk,
+    skLHE: c.skLHE,
+    used: c.queried,
+  }
+
+  c.interm = nil
+  c.sk = nil
+  c.skLHE = nil
+  return t
+}
+
+func (t *Token[T]) use() error {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  if t.used {
+    return ErrTokenUsed
+  }
+  t.used = true
+  return nil
+}
+
+func (t *Token[T]) Query(i uint64) (*pir.Query[T], error) {
+  if t.sk == nil {
+    panic("Token was preprocessed for LHE")
+  }
+  if err := t.use(); err != nil {
+    return nil, err
+  }
+  return t.pirClient.QueryPreprocessed(i, t.sk), nil
+}
+
+func (t *Token[T]) QueryLHE(q *matrix.Matrix[T]) (*pir.Query[T], error) {
+  if t.skLHE == nil {
+    panic("Token was preprocessed for PIR")
+  }
+  if err := t.use(); err != nil {
+    return nil, err
+  }
+  return t.pirClient.QueryLHEPreprocessed(q, t.skLHE), nil
+}
+
+func (t *Token[T]) Recover(ansIn *pir.Answer[T]) []uint64 {
+  ans := ansIn.Answer.Copy()
+  ans.Sub(t.interm)
+  return t.pirClient.DecodeMany(ans)
+}
+
+func (t *Token[T]) RecoverLHE(ansIn *pir.Answer[T]) *matrix.Matrix[T] {
+  ans := ansIn.Answer.Copy()
+  ans.Sub(t.interm)
+  return t.pirClient.DecodeManyLHE(ans)
+}